@@ -0,0 +1,90 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ReadChaptersFile reads chapters from a standalone chapters file, detecting
+// its format from the contents. Supported formats are ffmpeg's FFMETADATA1
+// (see ReadChaptersFromFFMetadata()), Matroska chapter XML (see
+// ReadChaptersFromMatroskaXML()), Podcasting 2.0 JSON chapters (see
+// ReadChaptersFromPodcastJSON()), Podlove Simple Chapters (see
+// ReadChaptersFromPSC()) and plain-text timestamp lists (see
+// ReadChaptersFromText()). The 'duration' should be the total duration
+// of the audio file; it is used as the end of the last chapter if the file
+// does not specify it.
+func ReadChaptersFile(path string, duration time.Duration) (FFProbeOutput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FFProbeOutput{}, err
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\ufeff")))
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(";FFMETADATA")):
+		return ReadChaptersFromFFMetadata(bytes.NewReader(data), duration)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return ReadChaptersFromPodcastJSON(bytes.NewReader(data), duration)
+	case bytes.HasPrefix(trimmed, []byte("<")) && bytes.Contains(trimmed, []byte(pscNamespace)):
+		return ReadChaptersFromPSC(bytes.NewReader(data), duration)
+	case bytes.HasPrefix(trimmed, []byte("<")) && bytes.Contains(trimmed, []byte("<Chapters")):
+		return ReadChaptersFromMatroskaXML(bytes.NewReader(data), duration)
+	}
+	out, err := ReadChaptersFromText(bytes.NewReader(data), duration)
+	if errors.Is(err, errNoTimestamps) {
+		return FFProbeOutput{}, fmt.Errorf("%s: unrecognized chapters file format", path)
+	}
+	return out, err
+}
+
+// A chapter read from a chapters file, whose end may not be known yet.
+type chapterEntry struct {
+	start  time.Duration
+	end    time.Duration
+	hasEnd bool
+	tags   map[string]string
+}
+
+// Converts the entries into chapters. An entry without an end time ends where
+// the next one starts, or at 'duration' if it is the last one.
+func chaptersFromEntries(entries []chapterEntry, duration time.Duration) ([]Chapter, error) {
+	chapters := make([]Chapter, 0, len(entries))
+	for i, e := range entries {
+		end := e.end
+		if !e.hasEnd {
+			end = duration
+			if i+1 < len(entries) {
+				end = entries[i+1].start
+			}
+		}
+		if end <= e.start {
+			if !e.hasEnd && i+1 == len(entries) {
+				return nil, fmt.Errorf("cannot determine end of chapter %d (input duration %v)", i, duration)
+			}
+			return nil, fmt.Errorf("chapter %d does not end after its start %v", i, e.start)
+		}
+		ch := NewChapter(i, e.start, end, "")
+		if e.tags != nil {
+			ch.Tags = e.tags
+		}
+		chapters = append(chapters, ch)
+	}
+	return chapters, nil
+}
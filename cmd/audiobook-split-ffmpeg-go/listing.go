@@ -0,0 +1,117 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ffmpegsplit "github.com/MawKKe/audiobook-split-ffmpeg-go"
+)
+
+// The formats supported by --format. The last ones export the selected
+// chapters in formats understood by other tools.
+var listingFormats = []string{"table", "json", "csv", "tsv", "ffmetadata", "podcast-json", "psc"}
+
+// writeChapterListing writes the chapter listing shown by --only-show-chapters.
+func writeChapterListing(w io.Writer, format string, imeta ffmpegsplit.InputFileMetadata, chapters []ffmpegsplit.ChapterInfo) error {
+	switch format {
+	case "ffmetadata":
+		return ffmpegsplit.WriteFFMetadata(w, imeta.FFProbeOutput.Format.Tags, selectedChapters(imeta, chapters))
+	case "podcast-json":
+		return ffmpegsplit.WritePodcastJSON(w, imeta.FFProbeOutput.Format.Tags, selectedChapters(imeta, chapters))
+	case "psc":
+		return ffmpegsplit.WritePSC(w, selectedChapters(imeta, chapters))
+	case "table":
+		return writeChapterTable(w, chapters)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			File     string                    `json:"file"`
+			Duration float64                   `json:"duration"`
+			Chapters []ffmpegsplit.ChapterInfo `json:"chapters"`
+		}{imeta.Path, imeta.Duration().Seconds(), chapters})
+	case "csv":
+		return writeChapterRecords(csv.NewWriter(w), chapters)
+	case "tsv":
+		cw := csv.NewWriter(w)
+		cw.Comma = '\t'
+		return writeChapterRecords(cw, chapters)
+	}
+	return fmt.Errorf("unknown format %q (expected one of %s)", format, strings.Join(listingFormats, ", "))
+}
+
+// Returns the chapters of the input file that are not filtered out.
+func selectedChapters(imeta ffmpegsplit.InputFileMetadata, infos []ffmpegsplit.ChapterInfo) []ffmpegsplit.Chapter {
+	var selected []ffmpegsplit.Chapter
+	for i, ch := range imeta.FFProbeOutput.Chapters {
+		if !infos[i].Filtered {
+			selected = append(selected, ch)
+		}
+	}
+	return selected
+}
+
+func writeChapterTable(w io.Writer, chapters []ffmpegsplit.ChapterInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTART\tEND\tDURATION\tTITLE\tOUTPUT")
+	for _, ch := range chapters {
+		output := strings.Join(ch.Outfiles, ", ")
+		if ch.Filtered {
+			output = "(filtered)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", ch.ID, formatTimestamp(ch.Start),
+			formatTimestamp(ch.End), formatTimestamp(ch.Duration), ch.Title, output)
+	}
+	return tw.Flush()
+}
+
+func writeChapterRecords(cw *csv.Writer, chapters []ffmpegsplit.ChapterInfo) error {
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+	}
+	cw.Write([]string{"id", "start", "end", "duration", "title", "filtered", "outfiles"})
+	for _, ch := range chapters {
+		cw.Write([]string{
+			strconv.Itoa(ch.ID),
+			seconds(ch.Start),
+			seconds(ch.End),
+			seconds(ch.Duration),
+			ch.Title,
+			strconv.FormatBool(ch.Filtered),
+			// several only if the chapter is subdivided
+			strings.Join(ch.Outfiles, "|"),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Formats duration like "1:02:03.450"
+func formatTimestamp(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	h := d / time.Hour
+	m := d % time.Hour / time.Minute
+	s := d % time.Minute / time.Second
+	ms := d % time.Second / time.Millisecond
+	return fmt.Sprintf("%d:%02d:%02d.%03d", h, m, s, ms)
+}
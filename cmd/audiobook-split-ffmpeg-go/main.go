@@ -15,42 +15,163 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	ffmpegsplit "github.com/MawKKe/audiobook-split-ffmpeg-go"
 	intervals "github.com/MawKKe/integer-interval-expressions-go"
 )
 
 type ProgramArgs struct {
-	InFile          string
+	InFiles         []string
 	OutDir          string
 	OnlyShowChaps   bool
 	OnlyShowCmds    bool
+	Format          string
 	Concurrency     int
 	NoUseTitle      bool
 	SwapExt         string
+	CueFile         string
+	ChaptersFile    string
+	FromSilence     bool
+	Silence         ffmpegsplit.SilenceDetectOpts
+	FixedSplit      ffmpegsplit.FixedSplitOpts
+	MaxChapterDur   time.Duration
+	Merge           ffmpegsplit.MergeOpts
+	GroupSize       int
+	GroupSeparator  string
+	EmbedChapters   bool
+	NameTemplate    string
+	Sanitize        ffmpegsplit.SanitizeProfile
+	MaxNameBytes    int
+	ExistingFiles   ffmpegsplit.ExistingFilePolicy
+	Process         ffmpegsplit.ProcessOpts
+	NoProgress      bool
+	CommandPrefix   string
+	NoCheck         bool
 	filterByChapter ffmpegsplit.ChapterFilterFunction
 }
 
 func ParseCommandline() (args ProgramArgs) {
-	flag.StringVar(&args.InFile, "infile", "",
-		"Input file path. REQUIRED.")
+	flag.Func("infile", "Input file path. REQUIRED. Repeat for a book split into several files\n"+
+		"(e.g. part01.mp3, part02.mp3, ...), which are then treated as one continuous input.",
+		func(s string) error {
+			args.InFiles = append(args.InFiles, s)
+			return nil
+		})
 	flag.StringVar(&args.OutDir, "outdir", "",
 		"Output directory path. REQUIRED.")
 	flag.BoolVar(&args.OnlyShowChaps, "only-show-chapters", false,
 		"Only show parsed chapters, then exit.")
+	flag.StringVar(&args.Format, "format", "table",
+		"Output format of --only-show-chapters: "+strings.Join(listingFormats, ", ")+".")
 	flag.BoolVar(&args.OnlyShowCmds, "only-show-commands", false,
-		"Only show final ffmpeg commands, then exit.")
+		"Only show final ffmpeg commands, then exit. Commands embedding chapters or spanning several\n"+
+			"input files refer to temporary files that only exist during processing; these are noted\n"+
+			"above the command.")
 	flag.IntVar(&args.Concurrency, "jobs", 0,
 		"Number of concurrent ffmpeg jobs (default: num of cpus).")
 	flag.BoolVar(&args.NoUseTitle, "no-use-title", false,
 		"Only show which ffmpeg commands would run, without running them.")
 	flag.StringVar(&args.SwapExt, "swap-extension", "",
 		"Use this output file extension instead (WARNING: may force audio re-encoding)")
+	flag.StringVar(&args.CueFile, "chapters-from-cue", "",
+		"Read chapters from this cue sheet instead of the input file metadata.")
+	flag.StringVar(&args.ChaptersFile, "chapters-file", "",
+		"Read chapters from this file instead of the input file metadata. Supported formats: FFMETADATA1,\n"+
+			"Matroska chapter XML, Podcasting 2.0 JSON, Podlove Simple Chapters and plain-text timestamp lists.")
+
+	args.Silence = ffmpegsplit.DefaultSilenceDetectOpts()
+	flag.BoolVar(&args.FromSilence, "chapters-from-silence", false,
+		"Synthesize chapters from silences in the input file instead of the input file metadata.")
+	flag.Float64Var(&args.Silence.NoiseThreshold, "silence-noise", args.Silence.NoiseThreshold,
+		"Audio quieter than this (in dB) is considered silence.")
+	flag.DurationVar(&args.Silence.MinSilence, "silence-min-duration", args.Silence.MinSilence,
+		"Ignore silences shorter than this.")
+	flag.DurationVar(&args.Silence.MinChapter, "silence-min-chapter", args.Silence.MinChapter,
+		"Do not synthesize chapters shorter than this.")
+	flag.DurationVar(&args.Silence.MaxChapter, "silence-max-chapter", args.Silence.MaxChapter,
+		"Forcibly cut synthesized chapters longer than this (0 = no limit).")
+	flag.IntVar(&args.FixedSplit.Count, "split-count", 0,
+		"Ignore chapter metadata, split the input file into this many equally long parts.")
+	flag.DurationVar(&args.FixedSplit.Every, "split-every", 0,
+		"Ignore chapter metadata, split the input file into parts of this length (e.g. 30m).")
+	flag.DurationVar(&args.FixedSplit.SnapWindow, "snap-to-silence", 0,
+		"With --split-count or --split-every, move cut points to the nearest silence within this distance.")
+
+	flag.DurationVar(&args.MaxChapterDur, "max-chapter-duration", 0,
+		"Split chapters longer than this into multiple parts of equal length (e.g. 1h).")
+
+	flag.IntVar(&args.GroupSize, "group-size", 0,
+		"Write this many consecutive chapters into each output file.")
+	flag.StringVar(&args.GroupSeparator, "group-by-title-prefix", "",
+		"Write consecutive chapters sharing the same title prefix before this separator (e.g. ':') into a single output file.")
+	flag.Func("name-template", "Template for output file names, e.g. '{book}/{num:03} {title}.{ext}'.\n"+
+		"Available fields: num, part, parts, total, title, duration, ext, basename,\n"+
+		"artist, album, author, book, tag.X (chapter tag X), meta.X (input file tag X).\n"+
+		"If the template does not end with {ext}, '.{ext}' is appended.",
+		func(s string) error {
+			if _, err := ffmpegsplit.ParseNameTemplate(s); err != nil {
+				return err
+			}
+			args.NameTemplate = s
+			return nil
+		})
+	flag.Func("sanitize", "Make file names safe for 'posix' (default), 'windows' (also FAT/exFAT) or 'ascii' file systems.",
+		func(s string) (err error) {
+			args.Sanitize, err = ffmpegsplit.ParseSanitizeProfile(s)
+			return err
+		})
+	flag.IntVar(&args.MaxNameBytes, "max-name-bytes", ffmpegsplit.DefaultMaxNameBytes,
+		"Truncate output file names longer than this many bytes.")
+	flag.Func("existing", "What to do with existing output files: 'fail' (default), 'skip', 'overwrite'\n"+
+		"or 'skip-if-identical-duration' (useful for resuming an interrupted run).",
+		func(s string) (err error) {
+			args.ExistingFiles, err = ffmpegsplit.ParseExistingFilePolicy(s)
+			return err
+		})
+	flag.DurationVar(&args.Process.TimeoutBase, "timeout", 0,
+		"Kill an ffmpeg job not finished within this time, plus --timeout-per-hour for each hour of audio.")
+	flag.DurationVar(&args.Process.TimeoutPerAudioHour, "timeout-per-hour", 0,
+		"Additional time allowed for an ffmpeg job per hour of audio (see --timeout).")
+	flag.DurationVar(&args.Process.StallTimeout, "stall-timeout", 0,
+		"Kill an ffmpeg job that makes no progress for this long.")
+	flag.IntVar(&args.Process.Retry.MaxAttempts, "attempts", 1,
+		"Run a failed ffmpeg job up to this many times in total, if the failure may be transient.")
+	flag.DurationVar(&args.Process.Retry.Backoff, "retry-backoff", 2*time.Second,
+		"Wait time before retrying a failed ffmpeg job; doubled on each subsequent retry.")
+	flag.StringVar(&args.Process.FFmpegPath, "ffmpeg", envOrDefault("FFMPEG_PATH", "ffmpeg"),
+		"Path to the ffmpeg binary. Defaults to $FFMPEG_PATH if set.")
+	flag.StringVar(&args.Process.FFprobePath, "ffprobe", envOrDefault("FFPROBE_PATH", "ffprobe"),
+		"Path to the ffprobe binary. Defaults to $FFPROBE_PATH if set.")
+	flag.BoolVar(&args.NoCheck, "no-check", false,
+		"Do not verify that ffmpeg and ffprobe are recent enough and support the required features.")
+	flag.StringVar(&args.CommandPrefix, "command-prefix", "",
+		"Run ffmpeg and ffprobe prefixed with this command, e.g. 'nice -n 19' or 'docker exec ctr'.")
+	flag.BoolVar(&args.NoProgress, "no-progress", false,
+		"Do not show progress while processing.")
+	flag.BoolVar(&args.EmbedChapters, "embed-chapters", false,
+		"Write chapter markers into each output file.")
+	flag.DurationVar(&args.Merge.MinDuration, "merge-shorter-than", 0,
+		"Merge chapters shorter than this into a neighbouring chapter (e.g. 5s).")
+	flag.Func("merge-into", "With --merge-shorter-than, merge into 'prev' (default) or 'next' chapter.",
+		func(s string) (err error) {
+			args.Merge.Direction, err = ffmpegsplit.ParseMergeDirection(s)
+			return err
+		})
+	flag.Func("merge-titles", "With --merge-shorter-than, 'keep' (default) the title of the merged-into chapter, or 'concat' all titles.",
+		func(s string) (err error) {
+			args.Merge.Titles, err = ffmpegsplit.ParseMergeTitles(s)
+			return err
+		})
 
 	var selectChaptersHelp string = "Exctract only the specified chapters.\n" +
 		"The argument value should be a comma-separated list of chapter\n" +
@@ -84,7 +205,7 @@ func ParseCommandline() (args ProgramArgs) {
 	// Both infile and outdir are required. However, the 'flag' package does not allow us
 	// to specify that in the option declaration like python argparse does...
 	var missing []string
-	if args.InFile == "" {
+	if len(args.InFiles) == 0 {
 		missing = append(missing, "infile")
 	}
 	if args.OutDir == "" {
@@ -96,34 +217,178 @@ func ParseCommandline() (args ProgramArgs) {
 		os.Exit(125)
 	}
 
+	var sources int
+	for _, given := range []bool{
+		args.CueFile != "",
+		args.ChaptersFile != "",
+		args.FromSilence,
+		args.FixedSplit.Count > 0 || args.FixedSplit.Every > 0,
+	} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		fmt.Println("ERROR: only one alternative chapter source may be specified")
+		os.Exit(125)
+	}
+
+	validFormat := false
+	for _, f := range listingFormats {
+		validFormat = validFormat || args.Format == f
+	}
+	if !validFormat {
+		fmt.Printf("ERROR: invalid --format %q (expected one of %s)\n", args.Format, strings.Join(listingFormats, ", "))
+		os.Exit(125)
+	}
+
+	if prefix := strings.Fields(args.CommandPrefix); len(prefix) > 0 {
+		runner := ffmpegsplit.PrefixRunner{Prefix: prefix}
+		args.Process.Runner = runner
+		args.Silence.Runner = runner
+	}
+	args.Silence.FFmpegPath = args.Process.FFmpegPath
+
 	return
 }
 
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Verifies that ffmpeg and ffprobe support everything needed for the
+// requested processing.
+func checkTools(ctx context.Context, args ProgramArgs) error {
+	_, err := ffmpegsplit.CheckFFprobe(ctx, args.Process.Runner, args.Process.FFprobePath)
+	if err != nil || args.OnlyShowCmds {
+		return err
+	}
+
+	// Only listing the chapters runs ffmpeg just for silence detection, if at all
+	silence := args.FromSilence || args.FixedSplit.SnapWindow > 0
+	if args.OnlyShowChaps && !silence {
+		return nil
+	}
+
+	var req ffmpegsplit.FFmpegRequirements
+	if !args.OnlyShowChaps {
+		req = ffmpegsplit.DefaultFFmpegRequirements()
+		ext := args.SwapExt
+		if ext == "" {
+			ext = strings.TrimPrefix(filepath.Ext(args.InFiles[0]), ".")
+		}
+		if muxer := ffmpegsplit.MuxerForExtension(ext); muxer != "" {
+			req.Muxers = append(req.Muxers, muxer)
+		}
+		if args.EmbedChapters || args.GroupSize > 0 || args.GroupSeparator != "" {
+			req.Demuxers = append(req.Demuxers, "ffmetadata")
+		}
+		if len(args.InFiles) > 1 {
+			req.Demuxers = append(req.Demuxers, "concat")
+		}
+	}
+	if silence {
+		req.Muxers = append(req.Muxers, "null")
+		req.Filters = append(req.Filters, "silencedetect")
+	}
+	_, err = ffmpegsplit.CheckFFmpeg(ctx, args.Process.Runner, args.Process.FFmpegPath, req)
+	return err
+}
+
 func main() {
 	args := ParseCommandline()
 
-	imeta, err := ffmpegsplit.ReadFile(args.InFile)
+	// Interrupting kills the running ffmpeg processes; their partial output
+	// files are cleaned up and no new processes are started.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !args.NoCheck {
+		if err := checkTools(ctx, args); err != nil {
+			fmt.Println(fmt.Errorf("ERROR: %w", err))
+			os.Exit(1)
+		}
+	}
+
+	probeOpts := ffmpegsplit.ProbeOpts{Runner: args.Process.Runner, FFprobePath: args.Process.FFprobePath}
+	imeta, err := ffmpegsplit.ReadFilesWithOptions(ctx, args.InFiles, probeOpts)
 
 	if err != nil {
 		fmt.Println(fmt.Errorf("Failed to read chapters: %w", err))
 		os.Exit(1)
-	} else if imeta.NumChapters() == 0 {
-		fmt.Println("Error(?): Input file has no chapter metadata. Cannot continue.")
-		os.Exit(2)
 	}
 
-	if args.OnlyShowChaps {
-		fmt.Printf("Found %v chapters:\n", imeta.NumChapters())
-		for _, chap := range imeta.FFProbeOutput.Chapters {
-			fmt.Printf("%+v\n", chap)
+	if args.ChaptersFile != "" {
+		chapters, err := ffmpegsplit.ReadChaptersFile(args.ChaptersFile, imeta.Duration())
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to read chapters file: %w", err))
+			os.Exit(1)
 		}
-		os.Exit(0)
+		imeta.ReplaceChapters(chapters)
+	}
+
+	if args.CueFile != "" {
+		cue, err := ffmpegsplit.ReadCueFile(args.CueFile, imeta.Duration())
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to read cue sheet: %w", err))
+			os.Exit(1)
+		}
+		imeta.ReplaceChapters(cue)
+	}
+
+	if args.FromSilence {
+		synth, err := imeta.ReadChaptersFromSilenceWithContext(ctx, args.Silence)
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to detect silences: %w", err))
+			os.Exit(1)
+		}
+		imeta.ReplaceChapters(synth)
+	}
+
+	if args.FixedSplit.Count > 0 || args.FixedSplit.Every > 0 {
+		var silences []ffmpegsplit.Silence
+		if args.FixedSplit.SnapWindow > 0 {
+			silences, err = imeta.DetectSilenceWithContext(ctx, args.Silence)
+			if err != nil {
+				fmt.Println(fmt.Errorf("Failed to detect silences: %w", err))
+				os.Exit(1)
+			}
+		}
+		chapters, err := ffmpegsplit.FixedChapters(imeta.Duration(), args.FixedSplit, silences)
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to split input: %w", err))
+			os.Exit(1)
+		}
+		imeta.FFProbeOutput.SetChapters(chapters)
+	}
+
+	if args.Merge.MinDuration > 0 {
+		imeta.FFProbeOutput.SetChapters(ffmpegsplit.MergeShortChapters(imeta.FFProbeOutput.Chapters, args.Merge))
+	}
+
+	if imeta.NumChapters() == 0 {
+		if err := imeta.FFProbeOutput.MediaMarkersErr; err != nil {
+			fmt.Println(fmt.Errorf("Failed to read chapters: %w", err))
+		}
+		fmt.Println("Error(?): Input file has no chapter metadata. Cannot continue.")
+		os.Exit(2)
 	}
 
 	opts := ffmpegsplit.DefaultOutFileOpts()
 
 	opts.UseTitleInName = !args.NoUseTitle
 	opts.UseAlternateExtension = args.SwapExt
+	opts.MaxChapterDuration = args.MaxChapterDur
+	opts.GroupSize = args.GroupSize
+	opts.GroupTitleSeparator = args.GroupSeparator
+	opts.EmbedChapters = args.EmbedChapters
+	opts.NameTemplate = args.NameTemplate
+	opts.Sanitize = args.Sanitize
+	opts.MaxNameBytes = args.MaxNameBytes
+	opts.ExistingFiles = args.ExistingFiles
 
 	if args.filterByChapter != nil {
 		opts.AddFilter(ffmpegsplit.ChapterFilter{
@@ -139,15 +404,36 @@ func main() {
 
 	//fmt.Printf("Computed %v WorkItems\n", len(workItems))
 
+	if args.OnlyShowChaps {
+		chapters := imeta.DescribeChapters(workItems, opts)
+		if err := writeChapterListing(os.Stdout, args.Format, imeta, chapters); err != nil {
+			fmt.Println(fmt.Errorf("Failed to list chapters: %w", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if args.OnlyShowCmds {
 		for i := range workItems {
-			fmt.Println(strings.Join(escapeCmd(workItems[i].GetCommand()), " "))
+			if files := workItems[i].TemporaryFiles(); len(files) > 0 {
+				fmt.Println("# requires temporary files written during processing:", strings.Join(escapeCmd(files), " "))
+			}
+			fmt.Println(strings.Join(escapeCmd(workItems[i].GetCommandWithOptions(args.Process)), " "))
 		}
 		os.Exit(0)
 	}
 
-	status := ffmpegsplit.Process(workItems, args.Concurrency)
-	fmt.Println("Status:", status)
+	processOpts := args.Process
+	processOpts.Retry.MaxBackoff = time.Minute
+	processOpts.MaxConcurrent = args.Concurrency
+	display := newProgressDisplay(os.Stdout, !args.NoProgress)
+	processOpts.Observer = display
+	status := ffmpegsplit.ProcessWithContext(ctx, workItems, processOpts).Status()
+	display.println("Status:", status)
+	if status.Cancelled > 0 {
+		stop()
+		os.Exit(130)
+	}
 }
 
 func escapeCmd(unescaped []string) []string {
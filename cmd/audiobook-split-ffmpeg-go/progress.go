@@ -0,0 +1,154 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	ffmpegsplit "github.com/MawKKe/audiobook-split-ffmpeg-go"
+)
+
+const (
+	ttyRedrawInterval   = 100 * time.Millisecond
+	plainReportInterval = 5 * time.Second
+)
+
+// progressDisplay is an ffmpegsplit.Observer that prints the result of each
+// job, and renders progress updates if enabled. On a terminal, a multi-line
+// display is redrawn in place: one line per running job, plus a line for the
+// overall progress. Otherwise the overall progress is printed as plain lines
+// every few seconds.
+type progressDisplay struct {
+	ffmpegsplit.NopObserver
+	out      *os.File
+	tty      bool
+	enabled  bool
+	running  []*ffmpegsplit.WorkItem
+	progress map[*ffmpegsplit.WorkItem]ffmpegsplit.Progress
+	overall  ffmpegsplit.PoolProgress
+	drawn    int
+	lastDraw time.Time
+}
+
+func newProgressDisplay(out *os.File, enabled bool) *progressDisplay {
+	return &progressDisplay{
+		out:      out,
+		tty:      isTerminal(out),
+		enabled:  enabled,
+		progress: make(map[*ffmpegsplit.WorkItem]ffmpegsplit.Progress),
+		lastDraw: time.Now(),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (d *progressDisplay) OnProgress(u ffmpegsplit.ProgressUpdate) {
+	if !d.enabled {
+		return
+	}
+	d.overall = u.Overall
+	if _, ok := d.progress[u.Item]; !ok && !u.Progress.Done {
+		d.running = append(d.running, u.Item)
+	}
+	if u.Progress.Done {
+		d.remove(u.Item)
+	} else {
+		d.progress[u.Item] = u.Progress
+	}
+
+	interval := plainReportInterval
+	if d.tty {
+		interval = ttyRedrawInterval
+	}
+	if time.Since(d.lastDraw) < interval {
+		return
+	}
+	d.lastDraw = time.Now()
+
+	if !d.tty {
+		fmt.Fprintln(d.out, "Progress:", formatOverall(d.overall))
+		return
+	}
+	d.clear()
+	for _, wi := range d.running {
+		p := d.progress[wi]
+		var percent float64
+		if dur := wi.Chapter.Duration(); dur > 0 {
+			percent = 100 * float64(p.OutTime) / float64(dur)
+		}
+		fmt.Fprintf(d.out, "  %5.1f%% %6.1fx  %s\n", percent, p.Speed, wi.Outfile)
+	}
+	fmt.Fprintln(d.out, "Overall:", formatOverall(d.overall))
+	d.drawn = len(d.running) + 1
+}
+
+func (d *progressDisplay) remove(wi *ffmpegsplit.WorkItem) {
+	delete(d.progress, wi)
+	for i := range d.running {
+		if d.running[i] == wi {
+			d.running = append(d.running[:i], d.running[i+1:]...)
+			break
+		}
+	}
+}
+
+func (d *progressDisplay) OnSuccess(res ffmpegsplit.Result) {
+	d.println("Done:", res.WorkItem.Outfile)
+}
+
+func (d *progressDisplay) OnSkipped(res ffmpegsplit.Result) {
+	d.println("Skipped:", res.WorkItem.Outfile)
+}
+
+func (d *progressDisplay) OnFailure(res ffmpegsplit.Result) {
+	switch {
+	case res.Cancelled:
+	case res.Attempts > 1:
+		d.println(fmt.Errorf("extraction failed after %d attempts: %v", res.Attempts, res.Err))
+	default:
+		d.println(fmt.Errorf("extraction failed: %v", res.Err))
+	}
+}
+
+// println prints a line of other output without garbling the display.
+func (d *progressDisplay) println(a ...interface{}) {
+	d.clear()
+	fmt.Fprintln(d.out, a...)
+}
+
+// clear erases the previously drawn lines on a terminal, so that other
+// output can be printed in their place.
+func (d *progressDisplay) clear() {
+	if !d.tty {
+		return
+	}
+	for ; d.drawn > 0; d.drawn-- {
+		fmt.Fprint(d.out, "\033[1A\033[2K")
+	}
+}
+
+func formatOverall(p ffmpegsplit.PoolProgress) string {
+	s := fmt.Sprintf("%5.1f%% (%v of %v audio)", p.Percent,
+		p.Processed.Round(time.Second), p.Total.Round(time.Second))
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", ETA %v", p.ETA.Round(time.Second))
+	}
+	return s
+}
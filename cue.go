@@ -0,0 +1,200 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cue sheet timestamps are expressed as mm:ss:ff, where ff is the number of
+// CD frames; there are 75 frames per second.
+const cueFramesPerSecond = 75
+
+// ReadCueFile is a convenience wrapper for ReadChaptersFromCue, reading the
+// cue sheet from file at path 'path'.
+func ReadCueFile(path string, duration time.Duration) (FFProbeOutput, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FFProbeOutput{}, err
+	}
+	defer f.Close()
+	return ReadChaptersFromCue(f, duration)
+}
+
+// ReadChaptersFromCue parses a cue sheet into a FFProbeOutput, as if the
+// chapters had been read from the audio file itself. Each TRACK becomes a
+// chapter starting at its INDEX 01 timestamp and ending where the next track
+// begins. The final track ends at 'duration', which should be the total
+// duration of the audio file (see InputFileMetadata.Duration()).
+//
+// Track TITLE and PERFORMER are stored in the chapter tags "title" and
+// "artist", respectively. The sheet-level TITLE and PERFORMER are stored in
+// the format tags "album" and "artist".
+//
+// Only single-FILE cue sheets are supported.
+func ReadChaptersFromCue(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	type cueTrack struct {
+		number int
+		start  time.Duration
+		found  bool
+		tags   map[string]string
+	}
+
+	var tracks []*cueTrack
+	formatTags := map[string]string{}
+	files := 0
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if lineno == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		fields := splitCueLine(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var cur *cueTrack
+		if len(tracks) > 0 {
+			cur = tracks[len(tracks)-1]
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			files++
+			if files > 1 {
+				return FFProbeOutput{}, fmt.Errorf("cue line %d: multiple FILE entries are not supported", lineno)
+			}
+		case "TRACK":
+			if len(fields) < 2 {
+				return FFProbeOutput{}, fmt.Errorf("cue line %d: malformed TRACK", lineno)
+			}
+			var num int
+			if _, err := fmt.Sscanf(fields[1], "%d", &num); err != nil {
+				return FFProbeOutput{}, fmt.Errorf("cue line %d: invalid track number %q", lineno, fields[1])
+			}
+			tracks = append(tracks, &cueTrack{number: num, tags: map[string]string{}})
+		case "TITLE", "PERFORMER":
+			if len(fields) < 2 {
+				continue
+			}
+			key := "title"
+			if strings.ToUpper(fields[0]) == "PERFORMER" {
+				key = "artist"
+			}
+			switch {
+			case cur != nil:
+				cur.tags[key] = fields[1]
+			case key == "title":
+				formatTags["album"] = fields[1]
+			default:
+				formatTags["artist"] = fields[1]
+			}
+		case "INDEX":
+			if cur == nil || len(fields) < 3 {
+				return FFProbeOutput{}, fmt.Errorf("cue line %d: unexpected INDEX", lineno)
+			}
+			if fields[1] != "01" && fields[1] != "1" {
+				// INDEX 00 denotes the pregap, other indices are sub-indices
+				// within the track. Neither affect the track start.
+				continue
+			}
+			ts, err := parseCueTimestamp(fields[2])
+			if err != nil {
+				return FFProbeOutput{}, fmt.Errorf("cue line %d: %w", lineno, err)
+			}
+			cur.start = ts
+			cur.found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return FFProbeOutput{}, err
+	}
+
+	chapters := make([]Chapter, 0, len(tracks))
+	for i, tr := range tracks {
+		if !tr.found {
+			return FFProbeOutput{}, fmt.Errorf("cue track %d has no INDEX 01", tr.number)
+		}
+		end := duration
+		if i+1 < len(tracks) {
+			end = tracks[i+1].start
+		}
+		if end <= tr.start {
+			if i+1 == len(tracks) {
+				return FFProbeOutput{}, fmt.Errorf("cannot determine end of cue track %d (input duration %v)", tr.number, duration)
+			}
+			return FFProbeOutput{}, fmt.Errorf("cue track %d does not start before track %d", tr.number, tracks[i+1].number)
+		}
+		ch := NewChapter(i, tr.start, end, "")
+		ch.Tags = tr.tags
+		chapters = append(chapters, ch)
+	}
+
+	var out FFProbeOutput
+	out.Format.Tags = formatTags
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+// Parses cue timestamp of the form mm:ss:ff
+func parseCueTimestamp(s string) (time.Duration, error) {
+	var mm, ss, ff int
+	if n, err := fmt.Sscanf(s, "%d:%d:%d", &mm, &ss, &ff); err != nil || n != 3 {
+		return 0, fmt.Errorf("invalid cue timestamp %q", s)
+	}
+	if ss >= 60 || ff >= cueFramesPerSecond || mm < 0 || ss < 0 || ff < 0 {
+		return 0, fmt.Errorf("invalid cue timestamp %q", s)
+	}
+	return time.Duration(mm)*time.Minute +
+		time.Duration(ss)*time.Second +
+		time.Duration(ff)*time.Second/cueFramesPerSecond, nil
+}
+
+// Splits cue sheet line into whitespace separated fields, keeping
+// double-quoted strings intact (without the quotes).
+func splitCueLine(line string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuotes, inField := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ChapterInfo describes a chapter of the input file, and what is going to be
+// done with it. When encoded as JSON, the times are given in seconds.
+type ChapterInfo struct {
+	ID       int               `json:"id"`
+	Title    string            `json:"title"`
+	Start    time.Duration     `json:"start"`
+	End      time.Duration     `json:"end"`
+	Duration time.Duration     `json:"duration"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// The chapter was excluded by OutFileOpts.Filters
+	Filtered bool `json:"filtered"`
+
+	// Output files (relative to the output directory) containing the chapter.
+	// There are several if the chapter is subdivided.
+	Outfiles []string `json:"outfiles"`
+}
+
+func (c ChapterInfo) MarshalJSON() ([]byte, error) {
+	type plain ChapterInfo
+	return json.Marshal(struct {
+		plain
+		Start    float64 `json:"start"`
+		End      float64 `json:"end"`
+		Duration float64 `json:"duration"`
+	}{plain(c), c.Start.Seconds(), c.End.Seconds(), c.Duration.Seconds()})
+}
+
+// DescribeChapters lists the chapters of the input file along with the
+// output files computed for them by ComputeWorkItems() with the same opts.
+func (imeta InputFileMetadata) DescribeChapters(workItems []WorkItem, opts OutFileOpts) []ChapterInfo {
+	outfiles := make(map[int][]string)
+	for _, wi := range workItems {
+		for _, ch := range wi.Chapters {
+			outfiles[ch.ID] = append(outfiles[ch.ID], wi.Outfile)
+		}
+	}
+
+	infos := make([]ChapterInfo, 0, len(imeta.FFProbeOutput.Chapters))
+	for _, ch := range imeta.FFProbeOutput.Chapters {
+		out := outfiles[ch.ID]
+		if out == nil {
+			out = []string{}
+		}
+		infos = append(infos, ChapterInfo{
+			ID:       ch.ID,
+			Title:    ch.Tags["title"],
+			Start:    ch.StartOffset(),
+			End:      ch.EndOffset(),
+			Duration: ch.Duration(),
+			Tags:     ch.Tags,
+			Filtered: opts.IsFiltered(ch),
+			Outfiles: out,
+		})
+	}
+	return infos
+}
@@ -0,0 +1,225 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadChaptersFromFFMetadata parses a file in ffmpeg's FFMETADATA1 format
+// (as produced by 'ffmpeg -i in.m4b -f ffmetadata out.txt') into a
+// FFProbeOutput. The global tags are stored as format tags, and each
+// [CHAPTER] section becomes a chapter, with its TIMEBASE, START and END keys
+// determining the chapter range and other keys stored as chapter tags. As in
+// ffmpeg, a missing TIMEBASE means nanoseconds. A chapter without END ends
+// where the next one starts, or at 'duration'.
+func ReadChaptersFromFFMetadata(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	type section struct {
+		name string
+		keys map[string]string
+		line int
+	}
+	var sections []*section
+	global := &section{keys: map[string]string{}}
+	cur := global
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	var pending string
+	continued := false
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if lineno == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+			if !strings.HasPrefix(line, ";FFMETADATA") {
+				return FFProbeOutput{}, fmt.Errorf("ffmetadata: missing ;FFMETADATA1 header")
+			}
+			continue
+		}
+		// a trailing unescaped backslash continues the value on the next line
+		if continued {
+			line = pending + "\n" + line
+		} else if strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if trailingBackslashes(line)%2 == 1 {
+			pending, continued = line[:len(line)-1], true
+			continue
+		}
+		pending, continued = "", false
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			cur = &section{name: trimmed, keys: map[string]string{}, line: lineno}
+			sections = append(sections, cur)
+			continue
+		}
+		key, value, ok := splitFFMetadataLine(line)
+		if !ok {
+			return FFProbeOutput{}, fmt.Errorf("ffmetadata line %d: expected key=value", lineno)
+		}
+		cur.keys[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return FFProbeOutput{}, err
+	}
+
+	var entries []chapterEntry
+	for _, sec := range sections {
+		if sec.name != "[CHAPTER]" {
+			// e.g. [STREAM] sections are of no interest here
+			continue
+		}
+		num, den := int64(1), int64(1000000000)
+		if tb, ok := sec.keys["TIMEBASE"]; ok {
+			if _, err := fmt.Sscanf(tb, "%d/%d", &num, &den); err != nil || num <= 0 || den <= 0 {
+				return FFProbeOutput{}, fmt.Errorf("ffmetadata line %d: invalid TIMEBASE %q", sec.line, tb)
+			}
+		}
+		toDuration := func(key string) (time.Duration, bool, error) {
+			s, ok := sec.keys[key]
+			if !ok {
+				return 0, false, nil
+			}
+			pts, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil || pts < 0 {
+				return 0, false, fmt.Errorf("ffmetadata line %d: invalid %s %q", sec.line, key, s)
+			}
+			return ptsToDuration(pts, num, den), true, nil
+		}
+		start, ok, err := toDuration("START")
+		if err != nil {
+			return FFProbeOutput{}, err
+		}
+		if !ok {
+			return FFProbeOutput{}, fmt.Errorf("ffmetadata line %d: chapter has no START", sec.line)
+		}
+		end, hasEnd, err := toDuration("END")
+		if err != nil {
+			return FFProbeOutput{}, err
+		}
+		tags := map[string]string{}
+		for k, v := range sec.keys {
+			if k != "TIMEBASE" && k != "START" && k != "END" {
+				tags[k] = v
+			}
+		}
+		entries = append(entries, chapterEntry{start: start, end: end, hasEnd: hasEnd, tags: tags})
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return FFProbeOutput{}, fmt.Errorf("ffmetadata: %w", err)
+	}
+	var out FFProbeOutput
+	out.Format.Tags = global.keys
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+func trailingBackslashes(s string) int {
+	n := 0
+	for n < len(s) && s[len(s)-1-n] == '\\' {
+		n++
+	}
+	return n
+}
+
+// Splits the line at the first unescaped '=', and unescapes both parts.
+func splitFFMetadataLine(line string) (string, string, bool) {
+	var key strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				key.WriteByte(line[i])
+			}
+		case '=':
+			return key.String(), unescapeFFMetadata(line[i+1:]), key.Len() > 0
+		default:
+			key.WriteByte(line[i])
+		}
+	}
+	return "", "", false
+}
+
+func unescapeFFMetadata(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// WriteFFMetadata writes the given global tags and chapters in ffmpeg's
+// FFMETADATA1 format. The chapter timestamps are written as-is, using the
+// time base of each chapter.
+func WriteFFMetadata(w io.Writer, tags map[string]string, chapters []Chapter) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, ";FFMETADATA1")
+	writeFFMetadataTags(bw, tags)
+	for _, ch := range chapters {
+		timebase := ch.TimeBase
+		if timebase == "" {
+			timebase = "1/1000"
+		}
+		fmt.Fprintln(bw, "[CHAPTER]")
+		fmt.Fprintf(bw, "TIMEBASE=%s\n", timebase)
+		fmt.Fprintf(bw, "START=%d\n", ch.Start)
+		fmt.Fprintf(bw, "END=%d\n", ch.End)
+		writeFFMetadataTags(bw, ch.Tags)
+	}
+	return bw.Flush()
+}
+
+// Writes tags in sorted order, so that the output is deterministic.
+func writeFFMetadataTags(w io.Writer, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s=%s\n", escapeFFMetadata(k), escapeFFMetadata(tags[k]))
+	}
+}
+
+var ffmetadataEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`=`, `\=`,
+	`;`, `\;`,
+	`#`, `\#`,
+	"\n", "\\\n",
+)
+
+// Special characters must be escaped with a backslash, see
+// https://ffmpeg.org/ffmpeg-formats.html#Metadata-2
+func escapeFFMetadata(s string) string {
+	return ffmetadataEscaper.Replace(s)
+}
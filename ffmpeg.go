@@ -17,31 +17,210 @@ package ffmpegsplit
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+// ExistingFilePolicy determines what happens when an output file already exists.
+type ExistingFilePolicy int
+
+const (
+	// ExistingFail makes the extraction fail if the output file exists.
+	ExistingFail ExistingFilePolicy = iota
+	// ExistingSkip leaves existing output files untouched and skips their extraction.
+	ExistingSkip
+	// ExistingOverwrite overwrites existing output files.
+	ExistingOverwrite
+	// ExistingSkipIfSameDuration skips the extraction if the existing output
+	// file has (approximately) the expected duration, and overwrites it
+	// otherwise. Useful for resuming an interrupted run.
+	ExistingSkipIfSameDuration
+)
+
+// ErrSkipped is returned by WorkItem.Process() when extraction was skipped due
+// to an existing output file (see ExistingFilePolicy).
+var ErrSkipped = errors.New("output file exists, skipped")
+
+// FFmpegError is returned when ffmpeg exits unsuccessfully.
+type FFmpegError struct {
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+func (e *FFmpegError) Error() string {
+	msg := strings.Trim(e.Stderr, "\n")
+	if msg != "" {
+		return fmt.Sprintf("ffmpeg error: %s: %v", msg, e.Err)
+	}
+	return fmt.Sprintf("ffmpeg error: %v", e.Err)
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when ffmpeg did not finish within the time limit
+// (see ProcessOpts.TimeoutBase). The ffmpeg process has been killed.
+type TimeoutError struct {
+	Outfile string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("ffmpeg timed out after %v while writing %s", e.Timeout, e.Outfile)
+}
+
+// StallError is returned when ffmpeg stopped making progress (see
+// ProcessOpts.StallTimeout). The ffmpeg process has been killed.
+type StallError struct {
+	Outfile string
+	// How long ffmpeg went without progress
+	Stalled time.Duration
+	// How much of the output had been written when the progress stopped
+	OutTime time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("ffmpeg stalled for %v at %v while writing %s", e.Stalled, e.OutTime, e.Outfile)
+}
+
+// How much the duration of an existing file may differ from the expected
+// duration, for ExistingSkipIfSameDuration. Stream copying cuts at packet
+// boundaries, so the durations are rarely exactly equal.
+const sameDurationTolerance = time.Second
+
+// ParseExistingFilePolicy converts the strings "fail", "skip", "overwrite" and
+// "skip-if-identical-duration" into ExistingFilePolicy.
+func ParseExistingFilePolicy(s string) (ExistingFilePolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail":
+		return ExistingFail, nil
+	case "skip", "skip-existing":
+		return ExistingSkip, nil
+	case "overwrite":
+		return ExistingOverwrite, nil
+	case "skip-if-identical-duration":
+		return ExistingSkipIfSameDuration, nil
+	}
+	return 0, fmt.Errorf("invalid existing file policy %q (expected fail, skip, overwrite or skip-if-identical-duration)", s)
+}
+
 // Chooses what the final chapter filename should be based on the options and
-// available metadata.
-func computeOutname(outdir string, opts OutFileOpts, ch Chapter, imeta InputFileMetadata) string {
+// available metadata. If the chapter has been subdivided (parts > 1), 'part'
+// is the 1-based part number, and 'duration' is the duration of the part.
+func computeOutname(tmpl NameTemplate, opts OutFileOpts, ch Chapter, duration time.Duration, part, parts, total int, imeta InputFileMetadata) string {
 	baseName := imeta.BaseNoExt
 	if Title, ok := ch.Tags["title"]; ok && opts.UseTitleInName {
 		baseName = Title
 	}
 
-	// adjusted chapter Id
-	num := ch.ID + opts.EnumOffset
-
 	ext := imeta.Extension
 
 	if opts.UseAlternateExtension != "" {
 		ext = opts.UseAlternateExtension
 	}
 
-	return fmt.Sprintf("%0*d - %v.%v", opts.EnumPaddedWidth, num, baseName, ext)
+	name := tmpl.execute(nameFields{
+		chapter:  ch,
+		duration: duration,
+		imeta:    imeta,
+		num:      ch.ID + opts.EnumOffset, // adjusted chapter Id
+		numWidth: opts.EnumPaddedWidth,
+		part:     part,
+		parts:    parts,
+		total:    total,
+		title:    baseName,
+		ext:      ext,
+		sanitize: opts.Sanitize,
+	})
+	return finalizeName(name, "."+SanitizeName(ext, opts.Sanitize), opts.Sanitize, opts.MaxNameBytes)
+}
+
+// Makes the name unique among the names produced so far, by adding a
+// numeric suffix if necessary.
+func uniqueOutname(name string, opts OutFileOpts, ext string, seen map[string]bool) string {
+	key := func(s string) string {
+		if opts.Sanitize.caseInsensitive() {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	unique := name
+	for n := 2; seen[key(unique)]; n++ {
+		unique = disambiguateName(name, "."+SanitizeName(ext, opts.Sanitize), n, opts.Sanitize, opts.MaxNameBytes)
+	}
+	seen[key(unique)] = true
+	return unique
+}
+
+// Splits the chapter into parts of equal length, none of which is longer than
+// 'max'. Returns the chapter as-is if no splitting is necessary.
+func subdivideChapter(ch Chapter, max time.Duration) []Chapter {
+	start, end := ch.StartOffset(), ch.EndOffset()
+	if max <= 0 || end-start <= max {
+		return []Chapter{ch}
+	}
+	n := int((end - start + max - 1) / max)
+	step := (end - start) / time.Duration(n)
+
+	parts := make([]Chapter, 0, n)
+	for i := 0; i < n; i++ {
+		partEnd := start + time.Duration(i+1)*step
+		if i == n-1 {
+			partEnd = end
+		}
+		part := NewChapter(ch.ID, start+time.Duration(i)*step, partEnd, "")
+		part.Tags = ch.Tags
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// A contiguous range of the input file to be written into a single output
+// file, along with the original chapters it consists of.
+type chapterSpan struct {
+	chapter  Chapter
+	members  []Chapter
+	filtered bool
+}
+
+// Produces the spans to be extracted, and the maximum span ID (for computing
+// the enumeration width). Without grouping, each chapter is a span of its own.
+func (imeta InputFileMetadata) chapterSpans(opts OutFileOpts) ([]chapterSpan, int, error) {
+	chapters := imeta.FFProbeOutput.Chapters
+	var spans []chapterSpan
+
+	if opts.GroupSize <= 1 && opts.GroupTitleSeparator == "" {
+		for _, chap := range chapters {
+			spans = append(spans, chapterSpan{chap, []Chapter{chap}, opts.IsFiltered(chap)})
+		}
+		return spans, imeta.FFProbeOutput.maxChapterID, nil
+	}
+
+	if opts.GroupSize > 1 && opts.GroupTitleSeparator != "" {
+		return nil, 0, fmt.Errorf("cannot group both by size and by title prefix")
+	}
+
+	// Filtering happens before grouping, so that the groups consist
+	// only of the selected chapters.
+	var selected []Chapter
+	for _, chap := range chapters {
+		if !opts.IsFiltered(chap) {
+			selected = append(selected, chap)
+		}
+	}
+	for i, group := range groupChapters(selected, opts.GroupSize, opts.GroupTitleSeparator) {
+		span := groupSpan(i, group, opts.GroupTitleSeparator)
+		spans = append(spans, chapterSpan{span, group, false})
+	}
+	return spans, len(spans) - 1, nil
 }
 
 // ComputeWorkItems processes struct workItem for each chapter. The workItem shall contain all
@@ -51,107 +230,469 @@ func computeOutname(outdir string, opts OutFileOpts, ch Chapter, imeta InputFile
 func (imeta InputFileMetadata) ComputeWorkItems(outdir string, opts OutFileOpts) ([]WorkItem, error) {
 	var wItems []WorkItem
 
+	spans, maxID, err := imeta.chapterSpans(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	nameTemplate := opts.NameTemplate
+	if nameTemplate == "" {
+		nameTemplate = DefaultNameTemplate
+	}
+	tmpl, err := ParseNameTemplate(nameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
 	if opts.EnumOffset < 0 {
 		opts.EnumOffset = 0
 	}
 
 	if opts.EnumPaddedWidth < 0 {
-		maxChAdjusted := imeta.FFProbeOutput.maxChapterID + opts.EnumOffset
+		maxChAdjusted := maxID + opts.EnumOffset
 		opts.EnumPaddedWidth = len(fmt.Sprintf("%d", maxChAdjusted))
 	}
 
+	// Normally the track numbers follow chapter IDs. If chapters are
+	// subdivided, all the parts are numbered sequentially instead, so that
+	// the track numbers still sort correctly. Filtered chapters are counted
+	// too, so that the numbering does not depend on the selection.
+	sequential := opts.MaxChapterDuration > 0 && len(spans) > 0
+	trackTotal := maxID + opts.EnumOffset
+	var track int
+	if sequential {
+		track = spans[0].chapter.ID + opts.EnumOffset
+		trackTotal = track - 1
+		for _, span := range spans {
+			trackTotal += len(subdivideChapter(span.chapter, opts.MaxChapterDuration))
+		}
+	}
+
+	ext := imeta.Extension
+	if opts.UseAlternateExtension != "" {
+		ext = opts.UseAlternateExtension
+	}
+	seen := make(map[string]bool)
+
 	// TODO deliver this information to user somehow
 	var filtered int
-	for _, chap := range imeta.FFProbeOutput.Chapters {
-		if opts.IsFiltered(chap) {
+	for _, span := range spans {
+		chap := span.chapter
+		parts := subdivideChapter(chap, opts.MaxChapterDuration)
+		if !sequential {
+			track = chap.ID + opts.EnumOffset
+		}
+		if span.filtered {
 			filtered++
+			track += len(parts)
 			continue
 		}
-		outfile := computeOutname(outdir, opts, chap, imeta)
-		wi := WorkItem{
-			Infile:       imeta.Path,
-			Outfile:      outfile,
-			OutDirectory: outdir,
-			Chapter:      chap,
-			imeta:        imeta,
-			opts:         opts,
+		for j, part := range parts {
+			partNum := 0
+			if len(parts) > 1 {
+				partNum = j + 1
+			}
+			outfile := computeOutname(tmpl, opts, chap, part.Duration(), partNum, len(parts), len(spans), imeta)
+			outfile = uniqueOutname(outfile, opts, ext, seen)
+			wi := WorkItem{
+				Outfile:      outfile,
+				OutDirectory: outdir,
+				Chapter:      part,
+				Chapters:     span.members,
+				Part:         partNum,
+				Parts:        len(parts),
+				imeta:        imeta,
+				opts:         opts,
+				track:        track,
+				trackTotal:   trackTotal,
+			}
+			in := wi.input()
+			wi.Infile, wi.Infiles = in.paths[0], in.paths
+			wItems = append(wItems, wi)
+			track++
 		}
-		wItems = append(wItems, wi)
 	}
 
 	return wItems, nil
 }
 
-// GetCommand produces a list of command line arguments that would produce the chapter file
-// specific to this workItem
+// EmbedsChapters tells whether the output file will contain chapter markers.
+// This is the case when the output file spans multiple chapters, or when
+// requested via OutFileOpts.EmbedChapters.
+func (wi WorkItem) EmbedsChapters() bool {
+	return len(wi.Chapters) > 1 || wi.opts.EmbedChapters
+}
+
+// EmbeddedChapters returns the chapters to be written in the output file:
+// the original chapters clipped to the range of this WorkItem, with
+// timestamps rebased so that the output file begins at zero.
+func (wi WorkItem) EmbeddedChapters() []Chapter {
+	start, end := wi.Chapter.StartOffset(), wi.Chapter.EndOffset()
+	var chapters []Chapter
+	for _, ch := range wi.Chapters {
+		chStart, chEnd := ch.StartOffset(), ch.EndOffset()
+		if chStart < start {
+			chStart = start
+		}
+		if chEnd > end {
+			chEnd = end
+		}
+		if chEnd <= chStart {
+			continue
+		}
+		rebased := NewChapter(len(chapters), chStart-start, chEnd-start, "")
+		for k, v := range ch.Tags {
+			rebased.Tags[k] = v
+		}
+		chapters = append(chapters, rebased)
+	}
+	return chapters
+}
+
+// Path of the temporary FFMETADATA1 file holding the embedded chapters.
+func (wi WorkItem) metadataFile() string {
+	return hiddenSibling(wi.outpath(), ".ffmetadata")
+}
+
+// Returns path to a hidden file residing next to 'path'.
+func hiddenSibling(path string, suffix string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+suffix)
+}
+
+// TemporaryFiles returns the helper files the ffmpeg arguments refer to
+// besides the input files: the metadata file holding the embedded chapters,
+// and the concat list of a WorkItem spanning several parts of a multi-file
+// input. They are written by Process() before running ffmpeg and removed
+// afterwards, so they do not exist otherwise.
+func (wi WorkItem) TemporaryFiles() []string {
+	var files []string
+	if wi.EmbedsChapters() {
+		files = append(files, wi.metadataFile())
+	}
+	if len(wi.input().paths) > 1 {
+		files = append(files, wi.concatListFile())
+	}
+	return files
+}
+
+// GetCommand is an alias for GetCommandWithOptions(ProcessOpts{})
 func (wi WorkItem) GetCommand() []string {
-	return append([]string{"ffmpeg"}, wi.FFmpegArgs()...)
+	return wi.GetCommandWithOptions(ProcessOpts{})
+}
+
+// GetCommandWithOptions produces a list of command line arguments that would produce the chapter file
+// specific to this workItem. Of 'opts', the FFmpegPath and the prefixes of a
+// PrefixRunner are used.
+func (wi WorkItem) GetCommandWithOptions(opts ProcessOpts) []string {
+	cmd := commandFor(opts.Runner, Cmd{Name: binaryOrDefault(opts.FFmpegPath, "ffmpeg"), Args: wi.FFmpegArgs()})
+	return append([]string{cmd.Name}, cmd.Args...)
 }
 
 // FFmpegArgs converts a WorkItem to a list of arguments that are going to be passed to
-// ffmpeg for actual processing step.
+// ffmpeg for actual processing step. Note that Process() actually writes into
+// a temporary file, which is renamed to the final name on success; these
+// arguments write into the final output file directly. The arguments may also
+// refer to temporary input files, see TemporaryFiles().
 func (wi WorkItem) FFmpegArgs() []string {
-	args := []string{
-		"-nostdin",
-		"-i", wi.imeta.Path,
+	overwrite := wi.opts.ExistingFiles == ExistingOverwrite || wi.opts.ExistingFiles == ExistingSkipIfSameDuration
+	return wi.ffmpegArgs(wi.outpath(), overwrite)
+}
+
+func (wi WorkItem) ffmpegArgs(outpath string, overwrite bool) []string {
+	in := wi.input()
+	args := []string{"-nostdin"}
+	if len(in.paths) > 1 {
+		args = append(args, "-f", "concat", "-safe", "0", "-i", wi.concatListFile())
+	} else {
+		args = append(args, "-i", in.paths[0])
+	}
+
+	if wi.EmbedsChapters() {
+		// The chapters in the metadata file are relative to the start of
+		// the output, but ffmpeg shifts mapped chapters by the output
+		// seek position (-ss). Offsetting the metadata input by the same
+		// amount cancels that out.
+		args = append(args,
+			"-itsoffset", in.startTime,
+			"-i", wi.metadataFile(),
+			"-map_chapters", "1",
+		)
+	} else {
+		args = append(args, "-map_chapters", "-1")
+	}
+
+	args = append(args,
 		"-v", "error",
-		"-map_chapters", "-1",
 		"-vn",
 		"-c", "copy",
-		"-ss", wi.Chapter.StartTime,
-		"-to", wi.Chapter.EndTime,
-		"-n",
+		"-ss", in.startTime,
+		"-to", in.endTime,
+	)
+
+	if overwrite {
+		args = append(args, "-y")
+	} else {
+		args = append(args, "-n")
 	}
 
 	var metadataTrack []string
 	if wi.opts.UseChapterNumberInMeta {
-		off := wi.opts.EnumOffset
-		metadataTrack = []string{"-metadata", fmt.Sprintf("track=%v/%v",
-			int(wi.Chapter.ID)+off,
-			wi.imeta.FFProbeOutput.maxChapterID+off)}
+		metadataTrack = []string{"-metadata", fmt.Sprintf("track=%v/%v", wi.track, wi.trackTotal)}
 	}
 
 	var metadataTitle []string
 
 	if Title, ok := wi.Chapter.Tags["title"]; ok && Title != "" && wi.opts.UseTitleInMeta {
+		if wi.Parts > 1 {
+			Title = fmt.Sprintf("%v (%d/%d)", Title, wi.Part, wi.Parts)
+		}
 		metadataTitle = []string{"-metadata", fmt.Sprintf("title=%v", Title)}
 	}
 
+	// The markers describe the whole input file; they would be wrong for
+	// the output file (and would be parsed as its chapters).
+	var metadataMarkers []string
+	if _, ok := wi.imeta.FFProbeOutput.mediaMarkers(); ok {
+		metadataMarkers = []string{"-metadata", MediaMarkersTag + "="}
+	}
+
+	// The concat demuxer does not carry over the file level metadata
+	var metadataFormat []string
+	if len(in.paths) > 1 {
+		tags := wi.imeta.FFProbeOutput.Format.Tags
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			if !strings.EqualFold(k, MediaMarkersTag) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			metadataFormat = append(metadataFormat, "-metadata", fmt.Sprintf("%v=%v", k, tags[k]))
+		}
+	}
+
+	args = append(args, metadataFormat...)
 	args = append(args, metadataTrack...)
 	args = append(args, metadataTitle...)
-	args = append(args, filepath.Join(wi.OutDirectory, wi.Outfile))
+	args = append(args, metadataMarkers...)
+	args = append(args, outpath)
 	return args
 }
 
+// Full path of the output file.
+func (wi WorkItem) outpath() string {
+	return filepath.Join(wi.OutDirectory, wi.Outfile)
+}
+
+// Path of the temporary file ffmpeg writes into. The file is hidden, and
+// resides in the same directory as the final file so that it can be renamed
+// atomically. The extension is kept, since ffmpeg chooses the output format
+// based on it.
+func (wi WorkItem) partialOutpath() string {
+	outpath := wi.outpath()
+	base := filepath.Base(outpath)
+	ext := filepath.Ext(base)
+	return filepath.Join(filepath.Dir(outpath), "."+strings.TrimSuffix(base, ext)+".partial"+ext)
+}
+
 func (wi WorkItem) Process() error {
-    return wi.ProcessWithContext(context.Background())
+	return wi.ProcessWithContext(context.Background())
 }
 
-// ProcessWithContext performs the actual processing step via ffmpeg.
-// Expects 'ffmpeg' be somewhere in user's $PATH.
+// ProcessWithContext is an alias for ProcessWithOptions(ctx, ProcessOpts{})
 func (wi WorkItem) ProcessWithContext(ctx context.Context) error {
+	return wi.ProcessWithOptions(ctx, ProcessOpts{})
+}
+
+// ProcessWithOptions performs the actual processing step via ffmpeg.
+// Unless opts.Runner or opts.FFmpegPath is given, expects 'ffmpeg' be
+// somewhere in user's $PATH. Returns ErrSkipped if the output file exists and
+// the policy says it should be left alone. Of 'opts', only the per-item
+// options (timeouts, Runner, binary paths and Observer.OnProgress()) are used.
+// If ffmpeg fails, the returned error is a *FFmpegError.
+//
+// The output is first written into a hidden temporary file, which is renamed
+// to the final name only after ffmpeg has finished successfully. On failure
+// or cancellation the temporary file is removed. Thus any file with the final
+// name is always complete. With ExistingFail, an output file appearing while
+// ffmpeg is running is not replaced; the extraction fails instead.
+func (wi WorkItem) ProcessWithOptions(ctx context.Context, opts ProcessOpts) error {
+	_, _, err := wi.process(ctx, opts)
+	return err
+}
+
+// Does the work of ProcessWithOptions(), additionally returning the
+// stderr output and exit code of ffmpeg (-1 if it was not run, or was killed).
+func (wi WorkItem) process(ctx context.Context, opts ProcessOpts) (string, int, error) {
+	skip, err := wi.skipExisting(ctx, opts)
+	if err != nil {
+		return "", -1, err
+	}
+	if skip {
+		return "", -1, ErrSkipped
+	}
+
+	outpath := wi.outpath()
+	if wi.opts.ExistingFiles == ExistingFail {
+		if _, err := os.Stat(outpath); err == nil {
+			return "", -1, fmt.Errorf("%w: %s", fs.ErrExist, outpath)
+		}
+	}
+
+	// The name template may place the output file in a subdirectory
 	const defaultPerm = 0755
-	err := os.MkdirAll(wi.OutDirectory, defaultPerm)
+	err = os.MkdirAll(filepath.Dir(outpath), defaultPerm)
 	if err != nil {
-		return err
+		return "", -1, err
 	}
 
-	// stdout should be empty on success
+	if wi.EmbedsChapters() {
+		if err := wi.writeMetadataFile(); err != nil {
+			return "", -1, err
+		}
+		defer os.Remove(wi.metadataFile())
+	}
+
+	if in := wi.input(); len(in.paths) > 1 {
+		if err := wi.writeConcatListFile(in.paths); err != nil {
+			return "", -1, err
+		}
+		defer os.Remove(wi.concatListFile())
+	}
+
+	// A leftover temporary file from an earlier crashed run is overwritten
+	partial := wi.partialOutpath()
+
+	runCtx := ctx
+	timeout := opts.itemTimeout(wi)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	runCtx, kill := context.WithCancel(runCtx)
+	defer kill()
+
+	watchdog := startStallWatchdog(opts.StallTimeout, kill)
+	progress := &progressParser{onReport: func(p Progress) {
+		watchdog.report(p)
+		if opts.Observer != nil {
+			opts.Observer.OnProgress(ProgressUpdate{Item: &wi, Progress: p})
+		}
+	}}
+
+	// stdout receives progress reports
 	// stderr will contain error message on failure
 	var stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, "ffmpeg", wi.FFmpegArgs()...)
-	cmd.Stderr = &stderr
+	cmd := Cmd{
+		Name:   binaryOrDefault(opts.FFmpegPath, "ffmpeg"),
+		Args:   append([]string{"-progress", "pipe:1", "-nostats"}, wi.ffmpegArgs(partial, true)...),
+		Stdout: progress,
+		Stderr: &stderr,
+	}
 
 	// Blocks until completion
-	err = cmd.Run()
+	err = runnerOrDefault(opts.Runner).Run(runCtx, cmd)
+	stalled, stalledFor, outTime := watchdog.stop()
+	code := exitCode(err)
+	if err != nil && runCtx.Err() != nil {
+		// killed due to cancellation, timeout or stall
+		code = -1
+	}
 
 	if err != nil {
-		msg := strings.Trim(stderr.String(), "\n")
-		if msg != "" {
-			return fmt.Errorf("ffmpeg error: %s: %w", msg, err)
+		os.Remove(partial)
+		switch {
+		case stalled:
+			return stderr.String(), code, &StallError{Outfile: wi.Outfile, Stalled: stalledFor, OutTime: outTime}
+		case ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded):
+			return stderr.String(), code, &TimeoutError{Outfile: wi.Outfile, Timeout: timeout}
+		}
+		return stderr.String(), code, &FFmpegError{Stderr: stderr.String(), ExitCode: code, Err: err}
+	}
+
+	if err := wi.commitOutput(partial, outpath); err != nil {
+		os.Remove(partial)
+		return stderr.String(), code, err
+	}
+
+	return stderr.String(), code, nil
+}
+
+// Creates a hard link; a variable so that tests can simulate file systems
+// without hard links.
+var linkFile = os.Link
+
+// Moves the finished temporary file into its final name. With ExistingFail,
+// the file is hard linked instead of renamed, since a rename would silently
+// replace a file that appeared after the existence check (e.g. from a
+// concurrent run). On file systems without hard links (such as FAT, exFAT and
+// many network mounts), the final name is claimed by exclusively creating an
+// empty file, which is then replaced by the rename.
+func (wi WorkItem) commitOutput(partial, outpath string) error {
+	if wi.opts.ExistingFiles != ExistingFail {
+		return os.Rename(partial, outpath)
+	}
+	err := linkFile(partial, outpath)
+	if err == nil {
+		return os.Remove(partial)
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		var claim *os.File
+		claim, err = os.OpenFile(outpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			claim.Close()
+			if err := os.Rename(partial, outpath); err != nil {
+				os.Remove(outpath)
+				return err
+			}
+			return nil
 		}
-		return fmt.Errorf("ffmpeg error: %w", err)
 	}
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: %s", fs.ErrExist, outpath)
+	}
+	return err
+}
 
-	return nil
+// Writes the chapters to be embedded in the output file into a temporary
+// metadata file, to be read by ffmpeg.
+func (wi WorkItem) writeMetadataFile() error {
+	f, err := os.Create(wi.metadataFile())
+	if err != nil {
+		return err
+	}
+	if err := WriteFFMetadata(f, nil, wi.EmbeddedChapters()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Decides whether processing should be skipped due to an existing output file.
+func (wi WorkItem) skipExisting(ctx context.Context, opts ProcessOpts) (bool, error) {
+	if wi.opts.ExistingFiles != ExistingSkip && wi.opts.ExistingFiles != ExistingSkipIfSameDuration {
+		return false, nil
+	}
+	outpath := wi.outpath()
+	if _, err := os.Stat(outpath); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if wi.opts.ExistingFiles == ExistingSkip {
+		return true, nil
+	}
+
+	existing, err := ReadChaptersWithOptions(ctx, outpath, ProbeOpts{Runner: opts.Runner, FFprobePath: opts.FFprobePath})
+	if err != nil {
+		// Probably a truncated file from an earlier interrupted run
+		return false, nil
+	}
+	diff := existing.Duration() - wi.Chapter.Duration()
+	if diff < 0 {
+		diff = -diff
+	}
+	return existing.Duration() > 0 && diff <= sameDurationTolerance, nil
 }
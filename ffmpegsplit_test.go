@@ -15,8 +15,17 @@
 package ffmpegsplit
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDecode(t *testing.T) {
@@ -70,3 +79,1048 @@ var chaptersJSON string = `
     ]
 }
 `
+
+// Returns the input file described by chaptersJSON.
+func beepInput(t *testing.T) InputFileMetadata {
+	t.Helper()
+	probeOut, err := ReadChaptersFromJSON([]byte(chaptersJSON))
+	if err != nil {
+		t.Fatalf("Failed to decode chapters JSON: %v", err)
+	}
+	return InputFileMetadata{Path: "beep.m4a", BaseNoExt: "beep", Extension: "m4a", FFProbeOutput: probeOut}
+}
+
+func TestReadChaptersFromCue(t *testing.T) {
+	out, err := ReadChaptersFromCue(strings.NewReader(cueSheet), 60*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to parse cue sheet: %v", err)
+	}
+	if len(out.Chapters) != 3 {
+		t.Fatalf("Expected 3 chapters, got %v", len(out.Chapters))
+	}
+	if out.Format.Tags["album"] != "Beeps" {
+		t.Fatalf("Unexpected album: %q", out.Format.Tags["album"])
+	}
+	second := out.Chapters[1]
+	if second.StartTime != "20.400000" || second.EndTime != "40.000000" {
+		t.Fatalf("Unexpected chapter range: %v - %v", second.StartTime, second.EndTime)
+	}
+	if second.Tags["title"] != "All You Can BEEP Buffee" || second.Tags["artist"] != "Beeper" {
+		t.Fatalf("Unexpected chapter tags: %v", second.Tags)
+	}
+	if out.Chapters[2].EndTime != "60.000000" {
+		t.Fatalf("Last chapter should end at input duration, got %v", out.Chapters[2].EndTime)
+	}
+	if _, err := ReadChaptersFromCue(strings.NewReader(cueSheet), 0); err == nil {
+		t.Fatalf("Expected error for unknown input duration")
+	}
+}
+
+var cueSheet string = `REM GENRE Audiobook
+PERFORMER "Beeper"
+TITLE "Beeps"
+FILE "beep.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "It All Started With a Simple BEEP"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "All You Can BEEP Buffee"
+    PERFORMER "Beeper"
+    INDEX 00 00:19:00
+    INDEX 01 00:20:30
+  TRACK 03 AUDIO
+    TITLE "The Final Beep"
+    INDEX 01 00:40:00
+`
+
+func TestChaptersFromSilences(t *testing.T) {
+	silences, err := ParseSilenceDetectOutput(strings.NewReader(silenceDetectLog))
+	if err != nil {
+		t.Fatalf("Failed to parse silencedetect output: %v", err)
+	}
+	if len(silences) != 3 {
+		t.Fatalf("Expected 3 silences, got %v", len(silences))
+	}
+
+	opts := SilenceDetectOpts{MinChapter: 10 * time.Second}
+	chapters := ChaptersFromSilences(silences, 60*time.Second, opts)
+	// The silence at ~25s would produce a 5 second chapter, so it is skipped
+	if len(chapters) != 3 {
+		t.Fatalf("Expected 3 chapters, got %v", len(chapters))
+	}
+	if chapters[1].StartTime != "20.500000" || chapters[1].EndTime != "40.500000" {
+		t.Fatalf("Unexpected chapter range: %v - %v", chapters[1].StartTime, chapters[1].EndTime)
+	}
+
+	opts.MaxChapter = 15 * time.Second
+	chapters = ChaptersFromSilences(silences, 60*time.Second, opts)
+	for _, ch := range chapters {
+		if ch.Duration() > opts.MaxChapter {
+			t.Fatalf("Chapter exceeds maximum length: %+v", ch)
+		}
+	}
+}
+
+var silenceDetectLog string = `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'beep-nochap.m4a':
+[silencedetect @ 0x5581c0] silence_start: 20
+[silencedetect @ 0x5581c0] silence_end: 21 | silence_duration: 1
+[silencedetect @ 0x5581c0] silence_start: 25
+[silencedetect @ 0x5581c0] silence_end: 26 | silence_duration: 1
+[silencedetect @ 0x5581c0] silence_start: 40
+[silencedetect @ 0x5581c0] silence_end: 41 | silence_duration: 1
+[silencedetect @ 0x5581c0] silence_start: 59.5
+size=N/A time=00:01:00.00 bitrate=N/A speed= 900x
+`
+
+func TestFixedChapters(t *testing.T) {
+	chapters, err := FixedChapters(100*time.Second, FixedSplitOpts{Count: 4}, nil)
+	if err != nil {
+		t.Fatalf("Failed to split: %v", err)
+	}
+	if len(chapters) != 4 || chapters[3].StartTime != "75.000000" || chapters[3].Tags["title"] != "Part 4" {
+		t.Fatalf("Unexpected chapters: %+v", chapters)
+	}
+
+	silences := []Silence{{Start: 28 * time.Second, End: 30 * time.Second}}
+	opts := FixedSplitOpts{Every: 30 * time.Second, SnapWindow: 5 * time.Second}
+	chapters, err = FixedChapters(100*time.Second, opts, silences)
+	if err != nil {
+		t.Fatalf("Failed to split: %v", err)
+	}
+	if len(chapters) != 4 {
+		t.Fatalf("Expected 4 chapters, got %v", len(chapters))
+	}
+	if chapters[0].EndTime != "29.000000" || chapters[1].EndTime != "60.000000" {
+		t.Fatalf("Cut points not snapped as expected: %+v", chapters)
+	}
+
+	// a window wider than half a step must not move a cut past its neighbours
+	silences = []Silence{{Start: 64 * time.Second, End: 66 * time.Second}}
+	opts = FixedSplitOpts{Every: 30 * time.Second, SnapWindow: 40 * time.Second}
+	chapters, err = FixedChapters(100*time.Second, opts, silences)
+	if err != nil {
+		t.Fatalf("Failed to split: %v", err)
+	}
+	for _, ch := range chapters {
+		if ch.Duration() <= 0 {
+			t.Fatalf("Chapters out of order: %+v", chapters)
+		}
+	}
+	if len(chapters) != 4 || chapters[0].EndTime != "30.000000" || chapters[1].EndTime != "65.000000" {
+		t.Fatalf("Cut points not snapped as expected: %+v", chapters)
+	}
+}
+
+func TestComputeWorkItemsSubdivided(t *testing.T) {
+	imeta := beepInput(t)
+	// make the middle chapter longer than the others
+	imeta.FFProbeOutput.Chapters[1].EndTime = "45.000000"
+	imeta.FFProbeOutput.Chapters[2].StartTime = "45.000000"
+
+	opts := DefaultOutFileOpts()
+	opts.MaxChapterDuration = 20 * time.Second
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if len(items) != 4 {
+		t.Fatalf("Expected 4 work items, got %v", len(items))
+	}
+	if items[1].Outfile != "1.1 - All You Can BEEP Buffee.m4a" || items[2].Outfile != "1.2 - All You Can BEEP Buffee.m4a" {
+		t.Fatalf("Unexpected output names: %q, %q", items[1].Outfile, items[2].Outfile)
+	}
+	if items[2].Chapter.StartTime != "32.500000" || items[2].Chapter.EndTime != "45.000000" {
+		t.Fatalf("Unexpected part range: %v - %v", items[2].Chapter.StartTime, items[2].Chapter.EndTime)
+	}
+	if items[3].track != 3 || items[3].trackTotal != 3 {
+		t.Fatalf("Unexpected track numbering: %v/%v", items[3].track, items[3].trackTotal)
+	}
+}
+
+func TestMergeShortChapters(t *testing.T) {
+	chapters := []Chapter{
+		NewChapter(0, 0, 3*time.Second, "Intro"),
+		NewChapter(1, 3*time.Second, 60*time.Second, "One"),
+		NewChapter(2, 60*time.Second, 62*time.Second, "Jingle"),
+		NewChapter(3, 62*time.Second, 120*time.Second, "Two"),
+	}
+
+	merged := MergeShortChapters(chapters, MergeOpts{MinDuration: 5 * time.Second})
+	if len(merged) != 2 {
+		t.Fatalf("Expected 2 chapters, got %v", len(merged))
+	}
+	// Intro has no predecessor, so it is merged into the next chapter
+	if merged[0].StartTime != "0.000000" || merged[0].EndTime != "62.000000" || merged[0].Tags["title"] != "One" {
+		t.Fatalf("Unexpected first chapter: %+v", merged[0])
+	}
+	if merged[1].ID != 1 || merged[1].StartTime != "62.000000" {
+		t.Fatalf("Unexpected second chapter: %+v", merged[1])
+	}
+
+	opts := MergeOpts{MinDuration: 5 * time.Second, Direction: MergeIntoNext, Titles: ConcatenateTitles}
+	merged = MergeShortChapters(chapters, opts)
+	if len(merged) != 2 || merged[0].Tags["title"] != "Intro / One" || merged[1].Tags["title"] != "Jingle / Two" {
+		t.Fatalf("Unexpected chapters: %+v", merged)
+	}
+	if merged[1].StartTime != "60.000000" {
+		t.Fatalf("Unexpected second chapter start: %v", merged[1].StartTime)
+	}
+}
+
+func TestComputeWorkItemsGrouped(t *testing.T) {
+	var probeOut FFProbeOutput
+	probeOut.SetChapters([]Chapter{
+		NewChapter(0, 0, 10*time.Second, "Part One: Arrival"),
+		NewChapter(1, 10*time.Second, 20*time.Second, "Part One: Departure"),
+		NewChapter(2, 20*time.Second, 30*time.Second, "Part Two: Return"),
+	})
+	imeta := InputFileMetadata{Path: "beep.m4a", BaseNoExt: "beep", Extension: "m4a", FFProbeOutput: probeOut}
+
+	opts := DefaultOutFileOpts()
+	opts.GroupTitleSeparator = ":"
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if len(items) != 2 || items[0].Outfile != "0 - Part One.m4a" || items[1].Outfile != "1 - Part Two.m4a" {
+		t.Fatalf("Unexpected work items: %+v", items)
+	}
+	if !items[0].EmbedsChapters() || items[1].EmbedsChapters() {
+		t.Fatalf("Only the multi-chapter group should embed chapters")
+	}
+	if files := items[0].TemporaryFiles(); len(files) != 1 || files[0] != items[0].metadataFile() || len(items[1].TemporaryFiles()) != 0 {
+		t.Fatalf("Unexpected temporary files: %v", files)
+	}
+	embedded := items[0].EmbeddedChapters()
+	if len(embedded) != 2 || embedded[1].StartTime != "10.000000" || embedded[1].Tags["title"] != "Part One: Departure" {
+		t.Fatalf("Unexpected embedded chapters: %+v", embedded)
+	}
+
+	var buf strings.Builder
+	if err := WriteFFMetadata(&buf, nil, embedded); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	if !strings.Contains(buf.String(), "START=10000\nEND=20000\ntitle=Part One: Departure\n") {
+		t.Fatalf("Unexpected metadata file content:\n%s", buf.String())
+	}
+
+	opts = DefaultOutFileOpts()
+	opts.GroupSize = 2
+	items, err = imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if len(items) != 2 || len(items[0].Chapters) != 2 || items[0].Chapter.EndTime != "20.000000" {
+		t.Fatalf("Unexpected work items: %+v", items)
+	}
+}
+
+func TestEmbedChaptersSubdivided(t *testing.T) {
+	var probeOut FFProbeOutput
+	probeOut.SetChapters([]Chapter{NewChapter(0, 0, 30*time.Second, "Long")})
+	imeta := InputFileMetadata{Path: "beep.m4a", BaseNoExt: "beep", Extension: "m4a", FFProbeOutput: probeOut}
+
+	opts := DefaultOutFileOpts()
+	opts.MaxChapterDuration = 20 * time.Second
+	opts.EmbedChapters = true
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if len(items) != 2 || !items[1].EmbedsChapters() {
+		t.Fatalf("Unexpected work items: %+v", items)
+	}
+	embedded := items[1].EmbeddedChapters()
+	if len(embedded) != 1 || embedded[0].StartTime != "0.000000" || embedded[0].EndTime != "15.000000" {
+		t.Fatalf("Unexpected embedded chapters: %+v", embedded)
+	}
+	args := strings.Join(items[1].FFmpegArgs(), " ")
+	if !strings.Contains(args, "-itsoffset 15.000000 -i out/.0.2 - Long.m4a.ffmetadata -map_chapters 1") {
+		t.Fatalf("Unexpected ffmpeg arguments: %v", args)
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	imeta := beepInput(t)
+	imeta.FFProbeOutput.Format.Tags = map[string]string{"album": "Beeps", "artist": "Beeper"}
+
+	opts := DefaultOutFileOpts()
+	opts.EnumOffset = 1
+	opts.NameTemplate = "{book}/{num:03} {title} [{duration}, {num}/{total}].{ext}"
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if want := "Beeps/002 All You Can BEEP Buffee [0m20s, 2/3].m4a"; items[1].Outfile != want {
+		t.Fatalf("Expected %q, got %q", want, items[1].Outfile)
+	}
+
+	// each part of a subdivided chapter has its own duration
+	opts.NameTemplate = "{num:03}-{part} [{duration}].{ext}"
+	opts.MaxChapterDuration = 15 * time.Second
+	items, err = imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if want := "001-1 [0m10s].m4a"; items[0].Outfile != want {
+		t.Fatalf("Expected %q, got %q", want, items[0].Outfile)
+	}
+
+	// the extension is added if the template does not end with it
+	opts = DefaultOutFileOpts()
+	opts.NameTemplate = "{author} - {book} - Part {num}"
+	items, err = imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if want := "Beeper - Beeps - Part 0.m4a"; items[0].Outfile != want {
+		t.Fatalf("Expected %q, got %q", want, items[0].Outfile)
+	}
+
+	for _, bad := range []string{"{nope}", "{title:03}", "{num", "{num:x}", "oops}"} {
+		if _, err := ParseNameTemplate(bad); err == nil {
+			t.Fatalf("Expected error for template %q", bad)
+		}
+	}
+}
+
+func TestSanitizedNames(t *testing.T) {
+	var probeOut FFProbeOutput
+	probeOut.SetChapters([]Chapter{
+		NewChapter(0, 0, 10*time.Second, "AC/DC: Live?"),
+		NewChapter(1, 10*time.Second, 20*time.Second, "Café…"),
+		NewChapter(2, 20*time.Second, 30*time.Second, "Same"),
+		NewChapter(3, 30*time.Second, 40*time.Second, "SAME"),
+		NewChapter(4, 40*time.Second, 50*time.Second, strings.Repeat("ä", 100)),
+	})
+	imeta := InputFileMetadata{Path: "beep.m4a", BaseNoExt: "beep", Extension: "m4a", FFProbeOutput: probeOut}
+
+	opts := DefaultOutFileOpts()
+	opts.NameTemplate = "{title}.{ext}"
+	opts.Sanitize = SanitizeASCII
+	opts.MaxNameBytes = 20
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	want := []string{"AC_DC_ Live_.m4a", "Cafe.m4a", "Same.m4a", "SAME (2).m4a", strings.Repeat("a", 16) + ".m4a"}
+	for i := range want {
+		if items[i].Outfile != want[i] {
+			t.Fatalf("Expected %q, got %q", want[i], items[i].Outfile)
+		}
+	}
+
+	opts.Sanitize = SanitizePOSIX
+	items, err = imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if items[0].Outfile != "AC_DC: Live?.m4a" || items[3].Outfile != "SAME.m4a" {
+		t.Fatalf("Unexpected names: %q, %q", items[0].Outfile, items[3].Outfile)
+	}
+	if len(items[4].Outfile) > 20 || !strings.HasSuffix(items[4].Outfile, "ä.m4a") {
+		t.Fatalf("Unexpected truncation: %q", items[4].Outfile)
+	}
+}
+
+func TestExistingSkip(t *testing.T) {
+	imeta := beepInput(t)
+
+	outdir := t.TempDir()
+	opts := DefaultOutFileOpts()
+	opts.ExistingFiles = ExistingSkip
+	items, err := imeta.ComputeWorkItems(outdir, opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outdir, items[0].Outfile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := items[0].Process(); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("Expected ErrSkipped, got %v", err)
+	}
+	if args := items[0].FFmpegArgs(); !strings.Contains(strings.Join(args, " "), " -n ") {
+		t.Fatalf("Expected -n in ffmpeg arguments: %v", args)
+	}
+}
+
+func TestAtomicOutput(t *testing.T) {
+	imeta := beepInput(t)
+
+	outdir := t.TempDir()
+	items, err := imeta.ComputeWorkItems(outdir, DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	want := filepath.Join(outdir, ".0 - It All Started With a Simple BEEP.partial.m4a")
+	if got := items[0].partialOutpath(); got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+
+	if err := os.WriteFile(filepath.Join(outdir, items[0].Outfile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := items[0].Process(); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Expected fs.ErrExist, got %v", err)
+	}
+
+	// the output file appears while ffmpeg is running, e.g. from a concurrent run
+	outpath := filepath.Join(outdir, items[1].Outfile)
+	runner := &RecordingRunner{Handler: func(ctx context.Context, cmd Cmd) error {
+		if err := os.WriteFile(outpath, []byte("concurrent"), 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], nil, 0644)
+	}}
+	if err := items[1].ProcessWithOptions(context.Background(), ProcessOpts{Runner: runner}); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Expected fs.ErrExist, got %v", err)
+	}
+	if content, _ := os.ReadFile(outpath); string(content) != "concurrent" {
+		t.Fatalf("Existing output file was overwritten")
+	}
+	if _, err := os.Stat(items[1].partialOutpath()); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Temporary file not removed: %v", err)
+	}
+
+	// without hard link support, the output is still produced, and an
+	// existing file is still not replaced
+	defer func(link func(string, string) error) { linkFile = link }(linkFile)
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrPermission}
+	}
+	if err := items[1].ProcessWithOptions(context.Background(), ProcessOpts{Runner: runner}); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Expected fs.ErrExist, got %v", err)
+	}
+	runner = &RecordingRunner{Handler: func(ctx context.Context, cmd Cmd) error {
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("extracted"), 0644)
+	}}
+	if err := items[2].ProcessWithOptions(context.Background(), ProcessOpts{Runner: runner}); err != nil {
+		t.Fatalf("Processing without hard links failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(outdir, items[2].Outfile)); string(content) != "extracted" {
+		t.Fatalf("Unexpected output file content %q", content)
+	}
+}
+
+func TestProcessCancelled(t *testing.T) {
+	imeta := beepInput(t)
+	items, err := imeta.ComputeWorkItems(t.TempDir(), DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := ProcessWithContext(ctx, items, ProcessOpts{MaxConcurrent: 2})
+	status := results.Status()
+	if status.Cancelled != 3 || status.Failed != 0 || status.Submitted != 3 {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	for i, res := range results {
+		if res.WorkItem != &items[i] {
+			t.Fatalf("Results not in WorkItem order at index %d", i)
+		}
+		if !errors.Is(res.Err, context.Canceled) || res.ExitCode != -1 {
+			t.Fatalf("Unexpected result %d: %+v", i, res)
+		}
+	}
+}
+
+func TestFFmpegError(t *testing.T) {
+	inner := errors.New("exit status 1")
+	err := error(&FFmpegError{Stderr: "Invalid argument\n", ExitCode: 1, Err: inner})
+	if err.Error() != "ffmpeg error: Invalid argument: exit status 1" {
+		t.Fatalf("Unexpected message: %q", err.Error())
+	}
+	var ferr *FFmpegError
+	if !errors.As(err, &ferr) || ferr.ExitCode != 1 || !errors.Is(err, inner) {
+		t.Fatalf("Unexpected error chain: %v", err)
+	}
+}
+
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) OnPlanned(workItems []WorkItem) {
+	o.events = append(o.events, fmt.Sprintf("planned %d", len(workItems)))
+}
+func (o *recordingObserver) OnStart(wi *WorkItem) { o.events = append(o.events, "start") }
+func (o *recordingObserver) OnSkipped(res Result) { o.events = append(o.events, "skipped") }
+func (o *recordingObserver) OnFinished(results Results) {
+	o.events = append(o.events, fmt.Sprintf("finished %d", len(results)))
+}
+
+func TestObserver(t *testing.T) {
+	imeta := beepInput(t)
+
+	outdir := t.TempDir()
+	opts := DefaultOutFileOpts()
+	opts.ExistingFiles = ExistingSkip
+	items, err := imeta.ComputeWorkItems(outdir, opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	for _, wi := range items {
+		if err := os.WriteFile(filepath.Join(outdir, wi.Outfile), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obs := &recordingObserver{}
+	status := ProcessWithContext(context.Background(), items, ProcessOpts{MaxConcurrent: 1, Observer: obs}).Status()
+	if status.Skipped != 3 {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	expected := "planned 3,start,skipped,start,skipped,start,skipped,finished 3"
+	if got := strings.Join(obs.events, ","); got != expected {
+		t.Fatalf("Unexpected events: %s", got)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	for _, err := range []error{ErrSkipped, context.Canceled, fmt.Errorf("%w: out.m4a", fs.ErrExist),
+		&FFmpegError{Stderr: "beep.m4a: Invalid data found when processing input"}} {
+		if IsRetryable(err) {
+			t.Fatalf("Expected %v not to be retryable", err)
+		}
+	}
+	for _, err := range []error{&StallError{}, &FFmpegError{Stderr: "Input/output error"}} {
+		if !IsRetryable(err) {
+			t.Fatalf("Expected %v to be retryable", err)
+		}
+	}
+
+	policy := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for retry, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 5 * time.Second} {
+		if got := policy.backoff(retry); got != expected {
+			t.Fatalf("Unexpected backoff for retry %d: %v", retry, got)
+		}
+	}
+
+	imeta := beepInput(t)
+	outdir := t.TempDir()
+	items, err := imeta.ComputeWorkItems(outdir, DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outdir, items[0].Outfile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := ProcessOpts{Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}}
+	res := ProcessWithContext(context.Background(), items[:1], opts)[0]
+	if !errors.Is(res.Err, fs.ErrExist) || res.Attempts != 1 {
+		t.Fatalf("Expected a single failed attempt, got %d: %v", res.Attempts, res.Err)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	runner := &RecordingRunner{Handler: func(ctx context.Context, cmd Cmd) error {
+		if cmd.Args[2] == "ffprobe" {
+			_, err := io.WriteString(cmd.Stdout, chaptersJSON)
+			return err
+		}
+		// ffmpeg: the output file is the last argument
+		if _, err := io.WriteString(cmd.Stdout, "out_time_us=20000000\nprogress=end\n"); err != nil {
+			return err
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], nil, 0644)
+	}}
+	prefixed := PrefixRunner{Prefix: []string{"nice", "-n", "19"}, Runner: runner}
+
+	imeta, err := ReadFileWithOptions(context.Background(), "beep.m4a", ProbeOpts{Runner: prefixed})
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	outdir := t.TempDir()
+	items, err := imeta.ComputeWorkItems(outdir, DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	status := ProcessWithContext(context.Background(), items, ProcessOpts{Runner: prefixed}).Status()
+	if status.Successful != 3 {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	if _, err := os.Stat(filepath.Join(outdir, items[2].Outfile)); err != nil {
+		t.Fatalf("Output file missing: %v", err)
+	}
+
+	cmds := runner.Commands()
+	if len(cmds) != 4 {
+		t.Fatalf("Expected 4 commands, got %v", len(cmds))
+	}
+	for _, cmd := range cmds {
+		if cmd.Name != "nice" || cmd.Args[0] != "-n" || cmd.Args[1] != "19" {
+			t.Fatalf("Command not prefixed: %v %v", cmd.Name, cmd.Args)
+		}
+	}
+	if cmds[0].Args[2] != "ffprobe" || cmds[1].Args[2] != "ffmpeg" {
+		t.Fatalf("Unexpected commands: %v, %v", cmds[0].Args, cmds[1].Args)
+	}
+
+	shown := items[0].GetCommandWithOptions(ProcessOpts{Runner: prefixed, FFmpegPath: "/opt/ffmpeg"})
+	if got := strings.Join(shown[:5], " "); got != "nice -n 19 /opt/ffmpeg -nostdin" {
+		t.Fatalf("Unexpected command: %v", shown)
+	}
+}
+
+func TestCheckFFmpeg(t *testing.T) {
+	outputs := map[string]string{
+		"-version": "ffmpeg version 4.4.2-0ubuntu0.22.04.1 Copyright (c) 2000-2021 the FFmpeg developers\n",
+		"-h": "Advanced global options:\n-progress url       write program-readable progress information\n" +
+			"-map_chapters input_file_index  set chapters mapping\n",
+		"-muxers":  "File formats:\n D. = Demuxing supported\n .E = Muxing supported\n --\n  E ipod            iPod H.264 MP4 (MPEG-4 Part 14)\n",
+		"-filters": "Filters:\n  T.. = Timeline support\n ..C silencedetect      A->A       Detect silence.\n",
+	}
+	runner := &RecordingRunner{Handler: func(ctx context.Context, cmd Cmd) error {
+		_, err := io.WriteString(cmd.Stdout, outputs[cmd.Args[1]])
+		return err
+	}}
+
+	req := DefaultFFmpegRequirements()
+	req.Muxers = []string{MuxerForExtension("m4b")}
+	req.Filters = []string{"silencedetect"}
+	info, err := CheckFFmpeg(context.Background(), runner, "/opt/ffmpeg/bin/ffmpeg", req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Major != 4 || info.Minor != 4 || info.Path != "/opt/ffmpeg/bin/ffmpeg" {
+		t.Fatalf("Unexpected version info: %+v", info)
+	}
+
+	req.Muxers = append(req.Muxers, "matroska")
+	if _, err := CheckFFmpeg(context.Background(), runner, "", req); !errors.Is(err, ErrUnsupported) ||
+		!strings.Contains(err.Error(), "muxer matroska") {
+		t.Fatalf("Expected missing muxer error, got %v", err)
+	}
+
+	outputs["-version"] = "ffmpeg version 3.4.8 Copyright (c) 2000-2020 the FFmpeg developers\n"
+	if _, err := CheckFFmpeg(context.Background(), runner, "", req); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected too old version error, got %v", err)
+	}
+	if runner.Commands()[0].Name != "/opt/ffmpeg/bin/ffmpeg" || runner.Commands()[len(runner.Commands())-1].Name != "ffmpeg" {
+		t.Fatalf("Unexpected binaries run: %v", runner.Commands())
+	}
+
+	info, err = ParseVersionOutput("ffprobe version N-109421-g9adf02247c Copyright (c) 2007-2022\n")
+	if err != nil || info.Version != "N-109421-g9adf02247c" || !info.atLeast(4, 0) {
+		t.Fatalf("Unexpected result for development build: %+v, %v", info, err)
+	}
+}
+
+func TestDescribeChapters(t *testing.T) {
+	imeta := beepInput(t)
+	opts := DefaultOutFileOpts()
+	opts.MaxChapterDuration = 15 * time.Second
+	opts.AddFilter(ChapterFilter{Description: "skip first", Filter: func(ch Chapter) bool { return ch.ID == 0 }})
+	items, err := imeta.ComputeWorkItems("out", opts)
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+
+	infos := imeta.DescribeChapters(items, opts)
+	if len(infos) != 3 || !infos[0].Filtered || len(infos[0].Outfiles) != 0 {
+		t.Fatalf("Unexpected chapter infos: %+v", infos)
+	}
+	if len(infos[1].Outfiles) != 2 || infos[1].Outfiles[1] != items[1].Outfile {
+		t.Fatalf("Unexpected output files: %v", infos[1].Outfiles)
+	}
+
+	encoded, err := json.Marshal(infos[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["start"] != 40.0 || decoded["duration"] != 20.0 || decoded["title"] != "The Final Beep" {
+		t.Fatalf("Unexpected JSON: %s", encoded)
+	}
+}
+
+func TestReadChaptersFile(t *testing.T) {
+	var buf strings.Builder
+	chapters := []Chapter{
+		NewChapter(0, 0, 20*time.Second, "Intro; the=beginning"),
+		NewChapter(1, 20*time.Second, 40*time.Second, "Two\nlines"),
+	}
+	if err := WriteFFMetadata(&buf, map[string]string{"album": "Beeps"}, chapters); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	metaPath := filepath.Join(dir, "chapters.txt")
+	if err := os.WriteFile(metaPath, []byte(buf.String()+"[CHAPTER]\nSTART=40000000000\ntitle=Last\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ReadChaptersFile(metaPath, 60*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read FFMETADATA: %v", err)
+	}
+	if len(out.Chapters) != 3 || out.Format.Tags["album"] != "Beeps" {
+		t.Fatalf("Unexpected result: %+v", out)
+	}
+	if out.Chapters[0].Tags["title"] != "Intro; the=beginning" || out.Chapters[1].Tags["title"] != "Two\nlines" {
+		t.Fatalf("Titles not unescaped: %q, %q", out.Chapters[0].Tags["title"], out.Chapters[1].Tags["title"])
+	}
+	if out.Chapters[2].StartTime != "40.000000" || out.Chapters[2].EndTime != "60.000000" {
+		t.Fatalf("Unexpected range for chapter without TIMEBASE and END: %v - %v",
+			out.Chapters[2].StartTime, out.Chapters[2].EndTime)
+	}
+
+	xmlPath := filepath.Join(dir, "chapters.xml")
+	if err := os.WriteFile(xmlPath, []byte(matroskaChaptersXML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = ReadChaptersFile(xmlPath, 60*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read Matroska XML: %v", err)
+	}
+	if len(out.Chapters) != 2 || out.Chapters[1].Tags["title"] != "The Final Beep" {
+		t.Fatalf("Unexpected chapters: %+v", out.Chapters)
+	}
+	if out.Chapters[0].EndTime != "40.500000" || out.Chapters[1].EndTime != "60.000000" {
+		t.Fatalf("Unexpected chapter ends: %v, %v", out.Chapters[0].EndTime, out.Chapters[1].EndTime)
+	}
+}
+
+var matroskaChaptersXML = `<?xml version="1.0"?>
+<!DOCTYPE Chapters SYSTEM "matroskachapters.dtd">
+<Chapters>
+  <EditionEntry>
+    <EditionFlagDefault>1</EditionFlagDefault>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:00.000000000</ChapterTimeStart>
+      <ChapterTimeEnd>00:00:40.500000000</ChapterTimeEnd>
+      <ChapterDisplay>
+        <ChapterString>It All Started With a Simple BEEP</ChapterString>
+        <ChapterLanguage>eng</ChapterLanguage>
+      </ChapterDisplay>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:20.000000000</ChapterTimeStart>
+      <ChapterFlagHidden>1</ChapterFlagHidden>
+      <ChapterDisplay>
+        <ChapterString>Hidden</ChapterString>
+      </ChapterDisplay>
+    </ChapterAtom>
+    <ChapterAtom>
+      <ChapterTimeStart>00:00:40.500000000</ChapterTimeStart>
+      <ChapterDisplay>
+        <ChapterString>The Final Beep</ChapterString>
+      </ChapterDisplay>
+    </ChapterAtom>
+  </EditionEntry>
+</Chapters>
+`
+
+func TestReadChaptersFromText(t *testing.T) {
+	list := "Chapters:\n0:00 Prologue\n[12:34] - Chapter 1\n1:02:03.5\tChapter 2: The Return\nEpilogue (1:30:00)\n"
+	out, err := ReadChaptersFromText(strings.NewReader(list), 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to parse chapter list: %v", err)
+	}
+	expected := []struct {
+		title string
+		start string
+		end   string
+	}{
+		{"Prologue", "0.000000", "754.000000"},
+		{"Chapter 1", "754.000000", "3723.500000"},
+		{"Chapter 2: The Return", "3723.500000", "5400.000000"},
+		{"Epilogue", "5400.000000", "7200.000000"},
+	}
+	if len(out.Chapters) != len(expected) {
+		t.Fatalf("Expected %v chapters, got %+v", len(expected), out.Chapters)
+	}
+	for i, e := range expected {
+		ch := out.Chapters[i]
+		if ch.Tags["title"] != e.title || ch.StartTime != e.start || ch.EndTime != e.end {
+			t.Fatalf("Unexpected chapter %d: %q %v - %v", i, ch.Tags["title"], ch.StartTime, ch.EndTime)
+		}
+	}
+
+	if _, err := ReadChaptersFromText(strings.NewReader("1:00 One\n0:30 Two\n"), time.Hour); err == nil {
+		t.Fatalf("Expected error for decreasing timestamps")
+	}
+}
+
+func TestPodcastChapters(t *testing.T) {
+	chapters := []Chapter{
+		NewChapter(0, 0, 20*time.Second, "Intro"),
+		NewChapter(1, 20*time.Second, 60*time.Second, "Beeps & Boops"),
+	}
+	chapters[1].Tags["img"] = "https://example.com/beep.jpg"
+	chapters[1].Tags["url"] = "https://example.com/beep"
+	tags := map[string]string{"title": "Episode 1", "album": "The Beep Show"}
+
+	dir := t.TempDir()
+	for name, write := range map[string]func(w io.Writer) error{
+		"chapters.json": func(w io.Writer) error { return WritePodcastJSON(w, tags, chapters) },
+		"chapters.psc":  func(w io.Writer) error { return WritePSC(w, chapters) },
+	} {
+		var buf strings.Builder
+		if err := write(&buf); err != nil {
+			t.Fatalf("%s: failed to write: %v", name, err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(buf.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ReadChaptersFile(path, 60*time.Second)
+		if err != nil {
+			t.Fatalf("%s: failed to read: %v\n%s", name, err, buf.String())
+		}
+		if len(out.Chapters) != 2 || out.Chapters[1].StartTime != "20.000000" || out.Chapters[1].EndTime != "60.000000" {
+			t.Fatalf("%s: unexpected chapters: %+v", name, out.Chapters)
+		}
+		for _, key := range []string{"title", "img", "url"} {
+			if out.Chapters[1].Tags[key] != chapters[1].Tags[key] {
+				t.Fatalf("%s: tag %s not preserved: %q", name, key, out.Chapters[1].Tags[key])
+			}
+		}
+	}
+
+	feed := `<rss xmlns:psc="http://podlove.org/simple-chapters"><channel><item>
+<psc:chapters version="1.2"><psc:chapter start="0" title="Intro"/><psc:chapter start="01:30.5" title="Main"/></psc:chapters>
+</item></channel></rss>`
+	out, err := ReadChaptersFromPSC(strings.NewReader(feed), time.Hour)
+	if err != nil || len(out.Chapters) != 2 || out.Chapters[1].StartTime != "90.500000" {
+		t.Fatalf("Unexpected chapters from feed: %+v, %v", out.Chapters, err)
+	}
+}
+
+func TestOverDriveMediaMarkers(t *testing.T) {
+	markers := `<Markers><Marker><Name>Chapter 1</Name><Time>0:00.000</Time></Marker>` +
+		`<Marker><Name>Chapter 1 (05:13)</Name><Time>5:13.000</Time></Marker>` +
+		`<Marker><Name>Chapter 2</Name><Time>12:34.500</Time></Marker></Markers>`
+	probeJSON, err := json.Marshal(map[string]interface{}{
+		"chapters": []interface{}{},
+		"format": map[string]interface{}{
+			"duration": "1500.000000",
+			"tags":     map[string]string{"album": "Beeps, Part 1", "OverDrive MediaMarkers": markers},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probeOut, err := ReadChaptersFromJSON(probeJSON)
+	if err != nil {
+		t.Fatalf("Failed to read media markers: %v", err)
+	}
+	if len(probeOut.Chapters) != 2 {
+		t.Fatalf("Expected 2 chapters, got %+v", probeOut.Chapters)
+	}
+	if second := probeOut.Chapters[1]; second.Tags["title"] != "Chapter 2" || second.StartTime != "754.500000" || second.EndTime != "1500.000000" {
+		t.Fatalf("Unexpected chapter: %+v", second)
+	}
+
+	imeta := InputFileMetadata{Path: "part1.mp3", BaseNoExt: "part1", Extension: "mp3", FFProbeOutput: probeOut}
+	items, err := imeta.ComputeWorkItems("out", DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	if args := strings.Join(items[0].FFmpegArgs(), " "); !strings.Contains(args, "-metadata OverDrive MediaMarkers= ") {
+		t.Fatalf("Expected media markers to be removed from output: %v", args)
+	}
+
+	// broken markers, or a missing duration, leave the chapters empty
+	// rather than failing, so that other chapter sources can still be used
+	for _, format := range []map[string]interface{}{
+		{"duration": "1500.000000", "tags": map[string]string{"OverDrive MediaMarkers": "<Markers><Marker><Name>Chapter 1"}},
+		{"tags": map[string]string{"OverDrive MediaMarkers": markers}},
+	} {
+		probeJSON, err := json.Marshal(map[string]interface{}{"chapters": []interface{}{}, "format": format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		probeOut, err := ReadChaptersFromJSON(probeJSON)
+		if err != nil {
+			t.Fatalf("Expected broken media markers not to fail reading: %v", err)
+		}
+		if len(probeOut.Chapters) != 0 || probeOut.MediaMarkersErr == nil {
+			t.Fatalf("Expected media markers error, got %+v", probeOut)
+		}
+	}
+}
+
+func TestMultiFileInput(t *testing.T) {
+	probeJSON := func(duration string, chapters ...Chapter) string {
+		out, err := json.Marshal(map[string]interface{}{
+			"chapters": chapters,
+			"format":   map[string]interface{}{"duration": duration, "tags": map[string]string{"album": "Beeps"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	outputs := map[string]string{
+		"part01.mp3": probeJSON("10.000000", NewChapter(0, 0, 4*time.Second, "One"), NewChapter(1, 4*time.Second, 10*time.Second, "Two")),
+		"part02.mp3": probeJSON("20.000000", NewChapter(0, 0, 20*time.Second, "Two (cont)")),
+		"od1.mp3":    probeJSON("600.000000", NewChapter(0, 0, 300*time.Second, "Chapter 1"), NewChapter(1, 300*time.Second, 600*time.Second, "Chapter 2")),
+		"od2.mp3": probeJSON("500.000000", NewChapter(0, 0, 240*time.Second, "Chapter 2 (05:00)"),
+			NewChapter(1, 240*time.Second, 500*time.Second, "Chapter 3")),
+	}
+	var concatList string
+	runner := &RecordingRunner{Handler: func(ctx context.Context, cmd Cmd) error {
+		if cmd.Name == "ffprobe" {
+			_, err := io.WriteString(cmd.Stdout, outputs[cmd.Args[1]])
+			return err
+		}
+		for i, arg := range cmd.Args {
+			if arg == "concat" {
+				list, err := os.ReadFile(cmd.Args[i+4])
+				if err != nil {
+					return err
+				}
+				concatList = string(list)
+			}
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], nil, 0644)
+	}}
+
+	imeta, err := ReadFilesWithOptions(context.Background(), []string{"part01.mp3", "part02.mp3"}, ProbeOpts{Runner: runner})
+	if err != nil {
+		t.Fatalf("Failed to read files: %v", err)
+	}
+	if imeta.Duration() != 30*time.Second || imeta.BaseNoExt != "part01" || len(imeta.Parts) != 2 || imeta.Parts[1].Offset != 10*time.Second {
+		t.Fatalf("Unexpected combined input: %+v", imeta)
+	}
+	if chaps := imeta.FFProbeOutput.Chapters; len(chaps) != 3 || chaps[2].ID != 2 || chaps[2].StartTime != "10.000000" || chaps[2].EndTime != "30.000000" {
+		t.Fatalf("Unexpected combined chapters: %+v", chaps)
+	}
+
+	// a chapter continuing from the previous part is merged into it
+	od, err := ReadFilesWithOptions(context.Background(), []string{"od1.mp3", "od2.mp3"}, ProbeOpts{Runner: runner})
+	if err != nil {
+		t.Fatalf("Failed to read files: %v", err)
+	}
+	if chaps := od.FFProbeOutput.Chapters; len(chaps) != 3 || chaps[1].Tags["title"] != "Chapter 2" ||
+		chaps[1].StartTime != "300.000000" || chaps[1].EndTime != "840.000000" || chaps[2].ID != 2 {
+		t.Fatalf("Unexpected combined chapters: %+v", chaps)
+	}
+
+	// replace the chapters with ones crossing the part boundary
+	var chapters FFProbeOutput
+	chapters.SetChapters([]Chapter{
+		NewChapter(0, 0, 4*time.Second, "One"),
+		NewChapter(1, 4*time.Second, 15*time.Second, "Two"),
+		NewChapter(2, 15*time.Second, 30*time.Second, "Three"),
+	})
+	imeta.ReplaceChapters(chapters)
+
+	outdir := t.TempDir()
+	items, err := imeta.ComputeWorkItems(outdir, DefaultOutFileOpts())
+	if err != nil {
+		t.Fatalf("Failed to compute work items: %v", err)
+	}
+	expected := []string{
+		"-nostdin -i part01.mp3 -map_chapters -1 -v error -vn -c copy -ss 0.000000 -to 4.000000",
+		"-nostdin -f concat -safe 0 -i " + items[1].concatListFile() + " -map_chapters -1 -v error -vn -c copy -ss 4.000000 -to 15.000000",
+		"-nostdin -i part02.mp3 -map_chapters -1 -v error -vn -c copy -ss 5.000000 -to 20.000000",
+	}
+	for i, item := range items {
+		if args := strings.Join(item.FFmpegArgs(), " "); !strings.HasPrefix(args, expected[i]) {
+			t.Fatalf("Unexpected arguments for item %d:\n%v\nexpected prefix:\n%v", i, args, expected[i])
+		}
+	}
+	if files := items[1].TemporaryFiles(); len(files) != 1 || files[0] != items[1].concatListFile() {
+		t.Fatalf("Unexpected temporary files: %v", files)
+	}
+	if items[2].Infile != "part02.mp3" || len(items[1].Infiles) != 2 || items[1].Infiles[1] != "part02.mp3" {
+		t.Fatalf("Unexpected input files: %v, %v", items[2].Infile, items[1].Infiles)
+	}
+	if args := strings.Join(items[1].FFmpegArgs(), " "); !strings.Contains(args, "-metadata album=Beeps ") {
+		t.Fatalf("Expected format tags to be copied: %v", args)
+	}
+	// the markers describe the input files, whatever the case of the tag
+	items[1].imeta.FFProbeOutput.Format.Tags["OVERDRIVE MEDIAMARKERS"] = "<Markers/>"
+	if args := strings.Join(items[1].FFmpegArgs(), " "); strings.Contains(args, "<Markers/>") {
+		t.Fatalf("Expected media markers not to be copied: %v", args)
+	}
+
+	status := ProcessWithContext(context.Background(), items[1:2], ProcessOpts{Runner: runner}).Status()
+	if status.Successful != 1 {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	abs, _ := filepath.Abs("part02.mp3")
+	if !strings.HasPrefix(concatList, "ffconcat version 1.0\n") || !strings.Contains(concatList, "file '"+abs+"'\n") {
+		t.Fatalf("Unexpected concat list: %q", concatList)
+	}
+	if _, err := os.Stat(items[1].concatListFile()); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Concat list not removed: %v", err)
+	}
+}
+
+func TestStallWatchdog(t *testing.T) {
+	killed := make(chan struct{})
+	w := startStallWatchdog(100*time.Millisecond, func() { close(killed) })
+	w.report(Progress{OutTime: 5 * time.Second})
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stall not detected")
+	}
+	stalled, stalledFor, outTime := w.stop()
+	if !stalled || stalledFor <= 100*time.Millisecond || outTime != 5*time.Second {
+		t.Fatalf("Unexpected stall: %v, %v, %v", stalled, stalledFor, outTime)
+	}
+}
+
+func TestProgressParser(t *testing.T) {
+	var reports []Progress
+	p := &progressParser{onReport: func(pr Progress) { reports = append(reports, pr) }}
+	out := "bitrate=N/A\nout_time_us=1500000\nspeed=N/A\nprogress=continue\nout_time_us=20000000\nsp"
+	if _, err := p.Write([]byte(out)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write([]byte("eed=41.5x\nprogress=end\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %v", len(reports))
+	}
+	if reports[0].OutTime != 1500*time.Millisecond || reports[0].Done {
+		t.Fatalf("Unexpected first report: %+v", reports[0])
+	}
+	if reports[1].OutTime != 20*time.Second || reports[1].Speed != 41.5 || !reports[1].Done {
+		t.Fatalf("Unexpected last report: %+v", reports[1])
+	}
+
+	opts := ProcessOpts{TimeoutBase: time.Minute, TimeoutPerAudioHour: 2 * time.Minute}
+	wi := WorkItem{Chapter: NewChapter(0, 0, 90*time.Minute, "")}
+	if got := opts.itemTimeout(wi); got != 4*time.Minute {
+		t.Fatalf("Unexpected timeout: %v", got)
+	}
+}
+
+func TestProgressAggregator(t *testing.T) {
+	items := []WorkItem{
+		{Chapter: NewChapter(0, 0, 30*time.Second, "")},
+		{Chapter: NewChapter(1, 30*time.Second, 60*time.Second, "")},
+	}
+	var last ProgressUpdate
+	agg := newProgressAggregator(items, func(u ProgressUpdate) { last = u })
+
+	agg.update(&items[0], Progress{OutTime: 15 * time.Second})
+	if last.Item != &items[0] || last.Overall.Total != 60*time.Second || last.Overall.Percent != 25 {
+		t.Fatalf("Unexpected update: %+v", last)
+	}
+	agg.finish(&items[1], false)
+	if last.Overall.Processed != 45*time.Second || !last.Progress.Done {
+		t.Fatalf("Unexpected update: %+v", last)
+	}
+
+	// skipped items take no time, so they must not speed up the estimate
+	items = append(items, WorkItem{Chapter: NewChapter(2, 60*time.Second, 120*time.Second, "")})
+	agg = newProgressAggregator(items, func(u ProgressUpdate) { last = u })
+	agg.finish(&items[2], true)
+	if last.Overall.Processed != 60*time.Second || last.Overall.ETA != 0 {
+		t.Fatalf("Unexpected update: %+v", last)
+	}
+	agg.update(&items[0], Progress{OutTime: 15 * time.Second})
+	if eta, elapsed := last.Overall.ETA, last.Overall.Elapsed; eta < 2*elapsed {
+		t.Fatalf("ETA %v too optimistic for elapsed %v", eta, elapsed)
+	}
+}
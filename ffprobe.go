@@ -20,28 +20,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 // ReadChaptersFromJSON parses the given byte sequence into a struct FFProbeOutput.
+// If the file has no chapters but carries OverDrive MediaMarkers (see
+// MediaMarkersTag), the chapters are produced from the markers. If that
+// fails, the error is stored in MediaMarkersErr rather than returned, so that
+// the chapters can still be taken from some other source.
 func ReadChaptersFromJSON(encoded []byte) (FFProbeOutput, error) {
 	var decoded FFProbeOutput
 	err := json.Unmarshal(encoded, &decoded)
 	if err != nil {
 		return FFProbeOutput{}, err
 	}
-
-	// find out what is the maximum chapter number. We don't assume that the
-	// chapters are in any specific order.
-	maxID := 0
-	for _, chap := range decoded.Chapters {
-		if chap.ID > maxID {
-			maxID = chap.ID
-		}
+	if markers, ok := decoded.mediaMarkers(); ok && len(decoded.Chapters) == 0 {
+		decoded.Chapters, decoded.MediaMarkersErr = ParseMediaMarkers(markers, decoded.Duration())
 	}
-	decoded.maxChapterID = maxID
+	decoded.SetChapters(decoded.Chapters)
 	return decoded, nil
 }
 
@@ -50,10 +47,24 @@ func ReadFile(infile string) (InputFileMetadata, error) {
 	return ReadFileWithContext(context.Background(), infile)
 }
 
-// ReadFileWithContext reads file metadata of file at path 'infile'.
-// The associated context is used for controlling the launched subprocesses
+// ProbeOpts contains options for reading file metadata via ffprobe.
+type ProbeOpts struct {
+	// Runs the ffprobe command; ExecRunner if nil.
+	Runner Runner
+
+	// Path to the ffprobe binary. If empty, it is looked up from $PATH.
+	FFprobePath string
+}
+
+// ReadFileWithContext is an alias for ReadFileWithOptions(ctx, infile, ProbeOpts{})
 func ReadFileWithContext(ctx context.Context, infile string) (InputFileMetadata, error) {
-	output, err := ReadChaptersWithContext(ctx, infile)
+	return ReadFileWithOptions(ctx, infile, ProbeOpts{})
+}
+
+// ReadFileWithOptions reads file metadata of file at path 'infile'.
+// The associated context is used for controlling the launched subprocesses
+func ReadFileWithOptions(ctx context.Context, infile string, opts ProbeOpts) (InputFileMetadata, error) {
+	output, err := ReadChaptersWithOptions(ctx, infile, opts)
 	if err != nil {
 		return InputFileMetadata{}, err
 	}
@@ -74,7 +85,7 @@ func ReadFileWithContext(ctx context.Context, infile string) (InputFileMetadata,
 // function is called by ReadFile() - as such it is only useful for debug
 // purposes.
 func GetReadChaptersCommandline(infile string) []string {
-	return []string{"-i", infile, "-v", "error", "-print_format", "json", "-show_chapters"}
+	return []string{"-i", infile, "-v", "error", "-print_format", "json", "-show_chapters", "-show_format"}
 }
 
 // ReadChapters is an alias for ReadChaptersWiithContext(context.Background(), infile)
@@ -82,23 +93,30 @@ func ReadChapters(infile string) (FFProbeOutput, error) {
 	return ReadChaptersWithContext(context.Background(), infile)
 }
 
-// ReadChaptersWithContext collects chapter information from the given file 'infile' using
+// ReadChaptersWithContext is an alias for ReadChaptersWithOptions(ctx, infile, ProbeOpts{})
+func ReadChaptersWithContext(ctx context.Context, infile string) (FFProbeOutput, error) {
+	return ReadChaptersWithOptions(ctx, infile, ProbeOpts{})
+}
+
+// ReadChaptersWithOptions collects chapter information from the given file 'infile' using
 // ffprobe. Blocks until subprocess returns. On success, parses the output
 // (JSON) and returns the information in struct FFProbeOutput. Otherwise
-// returns the error produced by either exec.Cmd.Run or json.Decoder.Unmarshal.
+// returns the error produced by either the Runner or json.Decoder.Unmarshal.
 //
-// Expects the program 'ffmpeg' to be somewhere in user's $PATH.
-func ReadChaptersWithContext(ctx context.Context, infile string) (FFProbeOutput, error) {
-	args := GetReadChaptersCommandline(infile)
-	cmd := exec.CommandContext(ctx, "ffprobe", args...)
-
+// Unless a Runner or a path is given, expects the program 'ffprobe' to be
+// somewhere in user's $PATH.
+func ReadChaptersWithOptions(ctx context.Context, infile string, opts ProbeOpts) (FFProbeOutput, error) {
 	// capture output for further processing and/or error handling
 	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd := Cmd{
+		Name:   binaryOrDefault(opts.FFprobePath, "ffprobe"),
+		Args:   GetReadChaptersCommandline(infile),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
 
 	// NOTE: Runs in blocking mode
-	err := cmd.Run()
+	err := runnerOrDefault(opts.Runner).Run(ctx, cmd)
 
 	if err != nil {
 		emsg := strings.TrimSuffix(stderr.String(), "\n")
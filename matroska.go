@@ -0,0 +1,114 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type matroskaChapters struct {
+	Editions []matroskaEdition `xml:"EditionEntry"`
+}
+
+type matroskaEdition struct {
+	Default int            `xml:"EditionFlagDefault"`
+	Atoms   []matroskaAtom `xml:"ChapterAtom"`
+}
+
+type matroskaAtom struct {
+	TimeStart string `xml:"ChapterTimeStart"`
+	TimeEnd   string `xml:"ChapterTimeEnd"`
+	// pointers, as the defaults differ from the zero values
+	Hidden   *int `xml:"ChapterFlagHidden"`
+	Enabled  *int `xml:"ChapterFlagEnabled"`
+	Displays []struct {
+		String   string `xml:"ChapterString"`
+		Language string `xml:"ChapterLanguage"`
+	} `xml:"ChapterDisplay"`
+}
+
+// ReadChaptersFromMatroskaXML parses a Matroska chapter XML file, as produced
+// by e.g. 'mkvextract chapters', into a FFProbeOutput. The chapters of the
+// default edition (or the first one, if none is marked default) are used;
+// hidden and disabled chapters, as well as nested sub-chapters, are ignored.
+// The first ChapterDisplay of each chapter is used as its title. A chapter
+// without ChapterTimeEnd ends where the next one starts, or at 'duration'.
+func ReadChaptersFromMatroskaXML(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	var doc matroskaChapters
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return FFProbeOutput{}, fmt.Errorf("matroska chapters: %w", err)
+	}
+	if len(doc.Editions) == 0 {
+		return FFProbeOutput{}, fmt.Errorf("matroska chapters: no EditionEntry found")
+	}
+	edition := doc.Editions[0]
+	for _, e := range doc.Editions {
+		if e.Default == 1 {
+			edition = e
+			break
+		}
+	}
+
+	var entries []chapterEntry
+	for _, atom := range edition.Atoms {
+		if (atom.Hidden != nil && *atom.Hidden == 1) || (atom.Enabled != nil && *atom.Enabled == 0) {
+			continue
+		}
+		start, err := parseMatroskaTimestamp(atom.TimeStart)
+		if err != nil {
+			return FFProbeOutput{}, fmt.Errorf("matroska chapters: %w", err)
+		}
+		e := chapterEntry{start: start, tags: map[string]string{}}
+		if atom.TimeEnd != "" {
+			if e.end, err = parseMatroskaTimestamp(atom.TimeEnd); err != nil {
+				return FFProbeOutput{}, fmt.Errorf("matroska chapters: %w", err)
+			}
+			e.hasEnd = true
+		}
+		if len(atom.Displays) > 0 && atom.Displays[0].String != "" {
+			e.tags["title"] = atom.Displays[0].String
+		}
+		entries = append(entries, e)
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return FFProbeOutput{}, fmt.Errorf("matroska chapters: %w", err)
+	}
+	var out FFProbeOutput
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+// Parses Matroska chapter timestamp of the form HH:MM:SS.nnnnnnnnn
+func parseMatroskaTimestamp(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec, err3 := parseSeconds(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || h < 0 || m < 0 || m >= 60 || sec < 0 || sec >= time.Minute {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + sec, nil
+}
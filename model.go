@@ -14,6 +14,8 @@
 
 package ffmpegsplit
 
+import "time"
+
 // Chapter represents a single chapter in ffprobe output JSON
 type Chapter struct {
 	ID        int               `json:"id"`
@@ -25,10 +27,24 @@ type Chapter struct {
 	Tags      map[string]string `json:"tags"`
 }
 
+// FFProbeFormat represents the container level details of the input file, as
+// reported by ffprobe (-show_format)
+type FFProbeFormat struct {
+	Filename   string            `json:"filename"`
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"` // in seconds, as a decimal string
+	Tags       map[string]string `json:"tags"`
+}
+
 // FFProbeOutput represents the JSON structure returned by ffprobe command
 type FFProbeOutput struct {
-	Chapters     []Chapter `json:"chapters"`
-	maxChapterID int       // hacky, but works..?
+	Chapters     []Chapter     `json:"chapters"`
+	Format       FFProbeFormat `json:"format"`
+	maxChapterID int           // hacky, but works..?
+
+	// Set if the chapters could not be read from the OverDrive MediaMarkers
+	// (see ReadChaptersFromJSON()), in which case there are no chapters.
+	MediaMarkersErr error `json:"-"`
 }
 
 // InputFileMetadata tepresents all important details of the input file.
@@ -38,18 +54,43 @@ type InputFileMetadata struct {
 	BaseNoExt     string
 	Extension     string
 	FFProbeOutput FFProbeOutput
+
+	// The consecutive files making up the input, if there are several (see
+	// ReadFilesWithOptions()). Path, BaseNoExt and Extension then refer to
+	// the first file, and the chapters to the combined timeline.
+	Parts []InputPart
 }
 
 // WorkItem represents all the required information for processing the input
 // file into a chapter specific file. To do the actual processing,
 // run WorkItem.Process()
 type WorkItem struct {
+	// The input file. With a multi-file input (see InputFileMetadata.Parts),
+	// this is the first of the files the item is extracted from; Infiles
+	// lists all of them, in order.
 	Infile       string
+	Infiles      []string
 	Outfile      string
 	OutDirectory string
-	Chapter      Chapter
-	imeta        InputFileMetadata
-	opts         OutFileOpts
+
+	// The time range to extract. If the original chapter was subdivided
+	// (see OutFileOpts.MaxChapterDuration), this covers only the part.
+	Chapter Chapter
+
+	// The original chapters covered by this WorkItem. Usually this is just
+	// the one chapter, but with grouping (see OutFileOpts.GroupSize) there
+	// may be several.
+	Chapters []Chapter
+
+	// 1-based part number and the total number of parts, if the chapter was
+	// subdivided. Otherwise Part is 0 and Parts is 1.
+	Part  int
+	Parts int
+
+	imeta      InputFileMetadata
+	opts       OutFileOpts
+	track      int
+	trackTotal int
 }
 
 // ChapterFilterFunction is a function that determines whether a chapter
@@ -105,6 +146,46 @@ type OutFileOpts struct {
 	// future...).
 	UseAlternateExtension string
 
+	// Template for the output file names, relative to the output directory.
+	// See ParseNameTemplate() for the syntax. If empty, DefaultNameTemplate
+	// is used.
+	NameTemplate string
+
+	// Determines how chapter titles and other metadata are made safe for use
+	// in file names. The zero value replaces only path separators.
+	Sanitize SanitizeProfile
+
+	// Maximum length of each output path component in bytes. Longer names
+	// are truncated, preserving the extension. Set to 0 for the default
+	// (DefaultMaxNameBytes).
+	MaxNameBytes int
+
+	// Chapters longer than this are split into multiple parts of equal
+	// length, each written into a separate file named like "005.2 - Title".
+	// Set to 0 to disable.
+	MaxChapterDuration time.Duration
+
+	// Group this many consecutive chapters into a single output file, instead
+	// of producing one file per chapter. The output files contain chapter
+	// markers for the grouped chapters. Set to 0 to disable.
+	GroupSize int
+
+	// Group consecutive chapters whose titles share the same prefix before
+	// this separator; e.g. with ":", chapters "Part One: Arrival" and
+	// "Part One: Departure" are grouped into a file titled "Part One".
+	// Mutually exclusive with GroupSize. Set to "" to disable.
+	GroupTitleSeparator string
+
+	// Write chapter markers into every output file, rebased so that the
+	// output file begins at zero. Output files spanning multiple chapters
+	// (see GroupSize) always contain chapter markers; with this option
+	// single-chapter files and subdivided parts get one as well.
+	EmbedChapters bool
+
+	// What to do when an output file already exists. The zero value makes
+	// the extraction of that chapter fail.
+	ExistingFiles ExistingFilePolicy
+
 	// Filters is a list of user-definable functions for filtering chapters.
 	// To add filter, use method AddFilter().
 	Filters []ChapterFilter
@@ -1,10 +1,129 @@
 package ffmpegsplit
 
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // NumChapters returns the number of chapters found in the input file.
 func (imeta InputFileMetadata) NumChapters() int {
 	return len(imeta.FFProbeOutput.Chapters)
 }
 
+// Duration returns the total duration of the input file, or 0 if unknown.
+func (imeta InputFileMetadata) Duration() time.Duration {
+	return imeta.FFProbeOutput.Duration()
+}
+
+// ReplaceChapters replaces the chapters of the input file with those found in
+// 'src', which is typically produced by some alternative chapter source (such
+// as a cue sheet). Format tags present in 'src' but missing from the input
+// file are copied over as well.
+func (imeta *InputFileMetadata) ReplaceChapters(src FFProbeOutput) {
+	imeta.FFProbeOutput.SetChapters(src.Chapters)
+	for k, v := range src.Format.Tags {
+		if _, ok := imeta.FFProbeOutput.Format.Tags[k]; ok {
+			continue
+		}
+		if imeta.FFProbeOutput.Format.Tags == nil {
+			imeta.FFProbeOutput.Format.Tags = make(map[string]string)
+		}
+		imeta.FFProbeOutput.Format.Tags[k] = v
+	}
+}
+
+// SetChapters replaces the list of chapters, updating any internal
+// bookkeeping that depends on it.
+func (out *FFProbeOutput) SetChapters(chapters []Chapter) {
+	// find out what is the maximum chapter number. We don't assume that the
+	// chapters are in any specific order.
+	maxID := 0
+	for _, chap := range chapters {
+		if chap.ID > maxID {
+			maxID = chap.ID
+		}
+	}
+	out.Chapters = chapters
+	out.maxChapterID = maxID
+}
+
+// Duration returns the duration reported in the format section, or 0 if unknown.
+func (out FFProbeOutput) Duration() time.Duration {
+	d, err := parseSeconds(out.Format.Duration)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// NewChapter builds a Chapter spanning the range [start, end). The time base
+// of the produced chapter is always 1/1000. If 'title' is non-empty, it is
+// stored in the chapter tags.
+func NewChapter(id int, start, end time.Duration, title string) Chapter {
+	ch := Chapter{
+		ID:        id,
+		TimeBase:  "1/1000",
+		Start:     int(start / time.Millisecond),
+		StartTime: formatSeconds(start),
+		End:       int(end / time.Millisecond),
+		EndTime:   formatSeconds(end),
+		Tags:      map[string]string{},
+	}
+	if title != "" {
+		ch.Tags["title"] = title
+	}
+	return ch
+}
+
+// StartOffset returns the chapter start as an offset from the beginning of the input file.
+func (ch Chapter) StartOffset() time.Duration {
+	return chapterOffset(ch.StartTime, ch.Start, ch.TimeBase)
+}
+
+// EndOffset returns the chapter end as an offset from the beginning of the input file.
+func (ch Chapter) EndOffset() time.Duration {
+	return chapterOffset(ch.EndTime, ch.End, ch.TimeBase)
+}
+
+// Duration returns the length of the chapter.
+func (ch Chapter) Duration() time.Duration {
+	return ch.EndOffset() - ch.StartOffset()
+}
+
+// Prefers the decimal time string, falls back to pts * time_base.
+func chapterOffset(seconds string, pts int, timebase string) time.Duration {
+	if d, err := parseSeconds(seconds); err == nil {
+		return d
+	}
+	var num, den int64
+	if _, err := fmt.Sscanf(timebase, "%d/%d", &num, &den); err != nil || den == 0 {
+		return 0
+	}
+	return ptsToDuration(int64(pts), num, den)
+}
+
+// Computes pts * num/den seconds, avoiding overflow with fine time bases
+// such as 1/1000000000.
+func ptsToDuration(pts, num, den int64) time.Duration {
+	ticks := pts * num
+	return time.Duration(ticks/den)*time.Second + time.Duration(ticks%den*int64(time.Second)/den)
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Round(f * float64(time.Second))), nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
 // AddFilter appends appends a filter to the list of filters in the OutFileOpts struct
 func (opts *OutFileOpts) AddFilter(flt ChapterFilter) {
 	opts.Filters = append(opts.Filters, flt)
@@ -30,6 +149,8 @@ func DefaultOutFileOpts() OutFileOpts {
 	opts.UseChapterNumberInMeta = true
 	opts.EnumOffset = -1
 	opts.EnumPaddedWidth = -1
+	opts.Sanitize = SanitizePOSIX
+	opts.MaxNameBytes = DefaultMaxNameBytes
 	return opts
 
 }
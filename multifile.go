@@ -0,0 +1,227 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InputPart is one file of an input consisting of several consecutive files,
+// see ReadFilesWithOptions().
+type InputPart struct {
+	Path string
+
+	// Where the part begins on the combined timeline
+	Offset time.Duration
+
+	// Duration of the part
+	Duration time.Duration
+}
+
+// End returns where the part ends on the combined timeline.
+func (p InputPart) End() time.Duration {
+	return p.Offset + p.Duration
+}
+
+// ReadFiles is an alias for ReadFilesWithOptions(context.Background(), infiles, ProbeOpts{})
+func ReadFiles(infiles []string) (InputFileMetadata, error) {
+	return ReadFilesWithOptions(context.Background(), infiles, ProbeOpts{})
+}
+
+// ReadFilesWithOptions reads the metadata of the files 'infiles', which are
+// consecutive parts of a single recording (such as part01.mp3 ... part12.mp3),
+// and combines them into one virtual input. The timeline of the combined input
+// is the concatenation of the parts, in the given order. The chapters of each
+// part are shifted onto the combined timeline and renumbered; a chapter
+// continuing from the previous part (such as the OverDrive marker
+// "Chapter 2 (05:00)" following "Chapter 2") is merged into it. The format tags
+// and file name are taken from the first part. The chapters may also be
+// replaced from any other source afterwards, e.g. via ReplaceChapters().
+//
+// WorkItems computed from the combined input extract ranges spanning several
+// parts via the ffmpeg concat demuxer. The duration of each part must be
+// known.
+func ReadFilesWithOptions(ctx context.Context, infiles []string, opts ProbeOpts) (InputFileMetadata, error) {
+	if len(infiles) == 0 {
+		return InputFileMetadata{}, fmt.Errorf("no input files")
+	}
+	if len(infiles) == 1 {
+		return ReadFileWithOptions(ctx, infiles[0], opts)
+	}
+
+	var combined InputFileMetadata
+	var chapters []Chapter
+	var offset time.Duration
+	for i, infile := range infiles {
+		imeta, err := ReadFileWithOptions(ctx, infile, opts)
+		if err != nil {
+			return InputFileMetadata{}, fmt.Errorf("%s: %w", infile, err)
+		}
+		duration := imeta.Duration()
+		if duration <= 0 {
+			return InputFileMetadata{}, fmt.Errorf("%s: unknown duration", infile)
+		}
+		if i == 0 {
+			combined = imeta
+		}
+		if err := imeta.FFProbeOutput.MediaMarkersErr; err != nil && combined.FFProbeOutput.MediaMarkersErr == nil {
+			combined.FFProbeOutput.MediaMarkersErr = fmt.Errorf("%s: %w", infile, err)
+		}
+		for j, ch := range imeta.FFProbeOutput.Chapters {
+			shifted := NewChapter(len(chapters), offset+ch.StartOffset(), offset+ch.EndOffset(), "")
+			shifted.Tags = ch.Tags
+			if n := len(chapters); j == 0 && n > 0 && continuesChapter(shifted, chapters[n-1], offset) {
+				prev := chapters[n-1]
+				chapters[n-1] = NewChapter(prev.ID, prev.StartOffset(), shifted.EndOffset(), "")
+				chapters[n-1].Tags = prev.Tags
+				continue
+			}
+			chapters = append(chapters, shifted)
+		}
+		combined.Parts = append(combined.Parts, InputPart{Path: infile, Offset: offset, Duration: duration})
+		offset += duration
+	}
+
+	combined.FFProbeOutput.Format.Duration = formatSeconds(offset)
+	combined.FFProbeOutput.SetChapters(chapters)
+	return combined, nil
+}
+
+// Tells whether the first chapter of a part, starting at 'offset' on the
+// combined timeline, merely continues the last chapter of the previous part.
+// This is the case when the chapter is a continuation marker (see
+// ParseMediaMarkers()), or has the same title and starts at the beginning
+// of the part.
+func continuesChapter(ch, prev Chapter, offset time.Duration) bool {
+	title, prevTitle := ch.Tags["title"], prev.Tags["title"]
+	if prevTitle == "" {
+		return false
+	}
+	if c := reMarkerContinuation.FindStringSubmatch(title); c != nil && c[1] == prevTitle {
+		return true
+	}
+	return title == prevTitle && ch.StartOffset() == offset
+}
+
+// DetectSilenceWithContext runs DetectSilenceWithContext() on the input. For
+// a multi-file input, each part is analyzed separately, and the silences are
+// shifted onto the combined timeline.
+func (imeta InputFileMetadata) DetectSilenceWithContext(ctx context.Context, opts SilenceDetectOpts) ([]Silence, error) {
+	if len(imeta.Parts) == 0 {
+		return DetectSilenceWithContext(ctx, imeta.Path, opts)
+	}
+	var silences []Silence
+	for _, part := range imeta.Parts {
+		found, err := DetectSilenceWithContext(ctx, part.Path, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", part.Path, err)
+		}
+		for _, s := range found {
+			silences = append(silences, Silence{Start: part.Offset + s.Start, End: part.Offset + s.End})
+		}
+	}
+	return silences, nil
+}
+
+// ReadChaptersFromSilenceWithContext is like the function of the same name,
+// but also supports multi-file inputs, see DetectSilenceWithContext().
+func (imeta InputFileMetadata) ReadChaptersFromSilenceWithContext(ctx context.Context, opts SilenceDetectOpts) (FFProbeOutput, error) {
+	duration := imeta.Duration()
+	if duration <= 0 {
+		return FFProbeOutput{}, fmt.Errorf("cannot synthesize chapters: unknown input duration")
+	}
+	silences, err := imeta.DetectSilenceWithContext(ctx, opts)
+	if err != nil {
+		return FFProbeOutput{}, err
+	}
+	var out FFProbeOutput
+	out.SetChapters(ChaptersFromSilences(silences, duration, opts))
+	return out, nil
+}
+
+// The input files of a WorkItem, and the time range to extract relative to
+// the beginning of the first one.
+type itemInput struct {
+	paths     []string
+	startTime string
+	endTime   string
+}
+
+// Determines which parts of a multi-file input the WorkItem covers. For a
+// single-file input, this is just the input file and the chapter times.
+func (wi WorkItem) input() itemInput {
+	parts := wi.imeta.Parts
+	if len(parts) == 0 {
+		return itemInput{[]string{wi.imeta.Path}, wi.Chapter.StartTime, wi.Chapter.EndTime}
+	}
+	start, end := wi.Chapter.StartOffset(), wi.Chapter.EndOffset()
+	var in itemInput
+	var base time.Duration
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if (part.End() <= start && !last) || (part.Offset >= end && len(in.paths) > 0) {
+			continue
+		}
+		if len(in.paths) == 0 {
+			base = part.Offset
+		}
+		in.paths = append(in.paths, part.Path)
+	}
+	in.startTime, in.endTime = formatSeconds(start-base), formatSeconds(end-base)
+	return in
+}
+
+// Path of the temporary concat demuxer script listing the input files, for
+// WorkItems spanning several parts of a multi-file input.
+func (wi WorkItem) concatListFile() string {
+	return hiddenSibling(wi.outpath(), ".ffconcat")
+}
+
+// Writes the input files of the WorkItem into a temporary concat script, to
+// be read by ffmpeg.
+func (wi WorkItem) writeConcatListFile(paths []string) error {
+	f, err := os.Create(wi.concatListFile())
+	if err != nil {
+		return err
+	}
+	if err := writeConcatList(f, paths); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writes a script for the ffmpeg concat demuxer. The script is read from a
+// different directory than the input files reside in, so the paths are made
+// absolute.
+func writeConcatList(w io.Writer, paths []string) error {
+	var sb strings.Builder
+	sb.WriteString("ffconcat version 1.0\n")
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
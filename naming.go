@@ -0,0 +1,251 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNameTemplate produces the output file names used when no template
+// is specified, e.g. "005 - Chapter Title.m4b".
+const DefaultNameTemplate = "{num} - {title}.{ext}"
+
+// NameTemplate is a parsed output file name template. See ParseNameTemplate()
+// for the syntax.
+type NameTemplate struct {
+	raw      string
+	segments []templateSegment
+}
+
+type templateSegment struct {
+	literal  string
+	field    string
+	width    int
+	hasWidth bool
+}
+
+// ParseNameTemplate parses an output file name template. The template
+// consists of literal text and placeholders of the form {field} or
+// {field:0N}, where the latter left-pads a numeric field with zeros to
+// width N. Literal braces are written as {{ and }}. The template may contain
+// path separators, in which case the output files are placed in
+// subdirectories of the output directory.
+//
+// Supported fields:
+//
+//	{num}       chapter number (see OutFileOpts.EnumOffset). If the chapter was
+//	            subdivided and the template does not use {part}, the part
+//	            number is appended as in "005.2"
+//	{part}      part number of a subdivided chapter, empty otherwise
+//	{parts}     number of parts of a subdivided chapter
+//	{total}     total number of chapters (or groups)
+//	{title}     chapter title, or input file name if title is not available
+//	{duration}  duration of the output file (i.e. of the part, if the
+//	            chapter was subdivided), e.g. "1h02m03s"
+//	{ext}       output file extension
+//	{basename}  input file name without extension
+//	{artist}    input file "artist" tag
+//	{album}     input file "album" tag
+//	{author}    input file "album_artist" tag, or "artist" if not available
+//	{book}      input file "album" tag, or input file name if not available
+//	{tag.X}     chapter tag X
+//	{meta.X}    input file tag X
+//
+// Unavailable tags produce an empty string. The field values are sanitized
+// according to OutFileOpts.Sanitize; the literal text is used as-is. If the
+// template does not end with {ext}, ".{ext}" is appended, since ffmpeg
+// chooses the output format based on the extension.
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	t := NameTemplate{raw: s}
+	var lit strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '{' && strings.HasPrefix(s[i:], "{{"):
+			lit.WriteByte('{')
+			i++
+		case c == '}' && strings.HasPrefix(s[i:], "}}"):
+			lit.WriteByte('}')
+			i++
+		case c == '}':
+			return NameTemplate{}, fmt.Errorf("name template %q: unmatched '}' at position %d", s, i)
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return NameTemplate{}, fmt.Errorf("name template %q: unterminated placeholder at position %d", s, i)
+			}
+			seg, err := parsePlaceholder(s[i+1 : i+end])
+			if err != nil {
+				return NameTemplate{}, fmt.Errorf("name template %q: %w", s, err)
+			}
+			if lit.Len() > 0 {
+				t.segments = append(t.segments, templateSegment{literal: lit.String()})
+				lit.Reset()
+			}
+			t.segments = append(t.segments, seg)
+			i += end
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	if lit.Len() > 0 {
+		t.segments = append(t.segments, templateSegment{literal: lit.String()})
+	}
+	if n := len(t.segments); n == 0 || t.segments[n-1].field != "ext" {
+		t.segments = append(t.segments, templateSegment{literal: "."}, templateSegment{field: "ext"})
+	}
+	return t, nil
+}
+
+func parsePlaceholder(p string) (templateSegment, error) {
+	name, spec, hasSpec := strings.Cut(p, ":")
+	seg := templateSegment{field: name}
+
+	switch {
+	case name == "num" || name == "part" || name == "parts" || name == "total":
+		if hasSpec {
+			width, err := strconv.Atoi(spec)
+			if err != nil || width < 0 || !strings.HasPrefix(spec, "0") {
+				return seg, fmt.Errorf("invalid width %q for {%s} (expected e.g. 03)", spec, name)
+			}
+			seg.width, seg.hasWidth = width, true
+		}
+		return seg, nil
+	case name == "title" || name == "duration" || name == "ext" || name == "basename" ||
+		name == "artist" || name == "album" || name == "author" || name == "book":
+	case strings.HasPrefix(name, "tag.") && len(name) > len("tag."):
+	case strings.HasPrefix(name, "meta.") && len(name) > len("meta."):
+	default:
+		return seg, fmt.Errorf("unknown field {%s}", p)
+	}
+	if hasSpec {
+		return seg, fmt.Errorf("field {%s} does not accept a format", name)
+	}
+	return seg, nil
+}
+
+// String returns the template in its original form.
+func (t NameTemplate) String() string {
+	return t.raw
+}
+
+// Tells whether the template references the given field.
+func (t NameTemplate) uses(field string) bool {
+	for _, seg := range t.segments {
+		if seg.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// The values available for expanding a name template.
+type nameFields struct {
+	chapter  Chapter
+	duration time.Duration
+	imeta    InputFileMetadata
+	num      int
+	numWidth int
+	part     int
+	parts    int
+	total    int
+	title    string
+	ext      string
+	sanitize SanitizeProfile
+}
+
+func (t NameTemplate) execute(f nameFields) string {
+	var sb strings.Builder
+	for _, seg := range t.segments {
+		if seg.field == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		sb.WriteString(SanitizeName(t.expand(seg, f), f.sanitize))
+	}
+	return sb.String()
+}
+
+func (t NameTemplate) expand(seg templateSegment, f nameFields) string {
+	number := func(n int, defaultWidth int) string {
+		width := defaultWidth
+		if seg.hasWidth {
+			width = seg.width
+		}
+		return fmt.Sprintf("%0*d", width, n)
+	}
+	formatTags := f.imeta.FFProbeOutput.Format.Tags
+
+	switch seg.field {
+	case "num":
+		num := number(f.num, f.numWidth)
+		if f.parts > 1 && !t.uses("part") {
+			num += "." + fmt.Sprintf("%0*d", len(strconv.Itoa(f.parts)), f.part)
+		}
+		return num
+	case "part":
+		if f.parts <= 1 {
+			return ""
+		}
+		return number(f.part, len(strconv.Itoa(f.parts)))
+	case "parts":
+		return number(f.parts, 0)
+	case "total":
+		return number(f.total, 0)
+	case "title":
+		return f.title
+	case "duration":
+		return formatDurationForName(f.duration)
+	case "ext":
+		return f.ext
+	case "basename":
+		return f.imeta.BaseNoExt
+	case "artist", "album":
+		return formatTags[seg.field]
+	case "author":
+		if author := formatTags["album_artist"]; author != "" {
+			return author
+		}
+		return formatTags["artist"]
+	case "book":
+		if book := formatTags["album"]; book != "" {
+			return book
+		}
+		return f.imeta.BaseNoExt
+	}
+	if key := strings.TrimPrefix(seg.field, "tag."); key != seg.field {
+		return f.chapter.Tags[key]
+	}
+	if key := strings.TrimPrefix(seg.field, "meta."); key != seg.field {
+		return formatTags[key]
+	}
+	return ""
+}
+
+// Formats duration like "1h02m03s", without characters that are problematic
+// in file names.
+func formatDurationForName(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	}
+	return fmt.Sprintf("%dm%02ds", m, s)
+}
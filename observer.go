@@ -0,0 +1,134 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import "sync"
+
+// Observer receives lifecycle events from ProcessWithContext(). The calls are
+// serialized, but may be made from different goroutines; the methods should
+// return quickly, as the processing waits for them. Embed NopObserver to
+// implement only some of the methods.
+type Observer interface {
+	// Called once before any processing starts.
+	OnPlanned(workItems []WorkItem)
+
+	// Called when a worker starts processing the item.
+	OnStart(wi *WorkItem)
+
+	// Called whenever an ffmpeg process reports progress (roughly twice a
+	// second per process) and whenever a WorkItem finishes.
+	OnProgress(u ProgressUpdate)
+
+	// Called when the output file of an item has been produced.
+	OnSuccess(res Result)
+
+	// Called when processing an item failed or was cancelled (see Result.Cancelled).
+	OnFailure(res Result)
+
+	// Called when an item was skipped due to an existing output file.
+	OnSkipped(res Result)
+
+	// Called once after all items have been processed.
+	OnFinished(results Results)
+}
+
+// NopObserver implements Observer by ignoring all events.
+type NopObserver struct{}
+
+func (NopObserver) OnPlanned(workItems []WorkItem) {}
+func (NopObserver) OnStart(wi *WorkItem)           {}
+func (NopObserver) OnProgress(u ProgressUpdate)    {}
+func (NopObserver) OnSuccess(res Result)           {}
+func (NopObserver) OnFailure(res Result)           {}
+func (NopObserver) OnSkipped(res Result)           {}
+func (NopObserver) OnFinished(results Results)     {}
+
+// Wraps an Observer so that calls to it are serialized.
+type serialObserver struct {
+	mu  sync.Mutex
+	obs Observer
+}
+
+func newSerialObserver(obs Observer) *serialObserver {
+	if obs == nil {
+		obs = NopObserver{}
+	}
+	return &serialObserver{obs: obs}
+}
+
+func (s *serialObserver) OnPlanned(workItems []WorkItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnPlanned(workItems)
+}
+
+func (s *serialObserver) OnStart(wi *WorkItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnStart(wi)
+}
+
+func (s *serialObserver) OnProgress(u ProgressUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnProgress(u)
+}
+
+func (s *serialObserver) OnSuccess(res Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnSuccess(res)
+}
+
+func (s *serialObserver) OnFailure(res Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnFailure(res)
+}
+
+func (s *serialObserver) OnSkipped(res Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnSkipped(res)
+}
+
+func (s *serialObserver) OnFinished(results Results) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obs.OnFinished(results)
+}
+
+// Delivers the result to the matching Observer method.
+func notifyResult(obs Observer, res Result) {
+	switch {
+	case res.Skipped:
+		obs.OnSkipped(res)
+	case res.Err != nil:
+		obs.OnFailure(res)
+	default:
+		obs.OnSuccess(res)
+	}
+}
+
+// Forwards the progress reports of a single item to the pool's aggregator.
+type itemObserver struct {
+	NopObserver
+	wi       *WorkItem
+	progress *progressAggregator
+}
+
+func (o itemObserver) OnProgress(u ProgressUpdate) {
+	o.progress.update(o.wi, u.Progress)
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MediaMarkersTag is the name of the ID3 TXXX frame (reported by ffprobe as
+// a format tag) in which OverDrive audiobooks store their chapter markers.
+const MediaMarkersTag = "OverDrive MediaMarkers"
+
+type mediaMarkers struct {
+	Markers []struct {
+		Name string `xml:"Name"`
+		Time string `xml:"Time"`
+	} `xml:"Marker"`
+}
+
+// A marker named like "Chapter 1 (05:13)" continues the chapter "Chapter 1"
+var reMarkerContinuation = regexp.MustCompile(`^(.*?)\s*\(\d+:\d{2}(?::\d{2})?\)$`)
+
+// ParseMediaMarkers parses the OverDrive MediaMarkers XML (see
+// MediaMarkersTag) into chapters. Each marker starts a chapter titled by its
+// Name, ending where the next one starts; the last one ends at 'duration'.
+// Markers that merely continue the previous chapter, such as
+// "Chapter 1 (05:13)" following "Chapter 1", do not start a new chapter.
+func ParseMediaMarkers(markers string, duration time.Duration) ([]Chapter, error) {
+	var doc mediaMarkers
+	if err := xml.Unmarshal([]byte(strings.TrimSpace(markers)), &doc); err != nil {
+		return nil, fmt.Errorf("overdrive media markers: %w", err)
+	}
+
+	var entries []chapterEntry
+	for _, m := range doc.Markers {
+		name := strings.TrimSpace(m.Name)
+		if n := len(entries); n > 0 {
+			if c := reMarkerContinuation.FindStringSubmatch(name); c != nil && c[1] == entries[n-1].tags["title"] {
+				continue
+			}
+		}
+		start, err := parseMarkerTime(m.Time)
+		if err != nil {
+			return nil, fmt.Errorf("overdrive media markers: %w", err)
+		}
+		if n := len(entries); n > 0 && start <= entries[n-1].start {
+			return nil, fmt.Errorf("overdrive media markers: marker %q is not after the previous one", name)
+		}
+		e := chapterEntry{start: start, tags: map[string]string{}}
+		setTagIfNonEmpty(e.tags, "title", name)
+		entries = append(entries, e)
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return nil, fmt.Errorf("overdrive media markers: %w", err)
+	}
+	return chapters, nil
+}
+
+// Parses marker time such as "5:13.000", "1:05:13.000" or plain seconds.
+func parseMarkerTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ":") {
+		return parseSeconds(s)
+	}
+	return parseTextTimestamp(s)
+}
+
+// Returns the value of the OverDrive MediaMarkers tag, if present. Tag names
+// are compared case-insensitively, as their case varies between containers.
+func (out FFProbeOutput) mediaMarkers() (string, bool) {
+	for k, v := range out.Format.Tags {
+		if strings.EqualFold(k, MediaMarkersTag) {
+			return v, true
+		}
+	}
+	return "", false
+}
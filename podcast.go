@@ -0,0 +1,278 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Podcasting 2.0 JSON chapters, see
+// https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+type podcastChapters struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title,omitempty"`
+	Author      string           `json:"author,omitempty"`
+	PodcastName string           `json:"podcastName,omitempty"`
+	Chapters    []podcastChapter `json:"chapters"`
+}
+
+type podcastChapter struct {
+	StartTime float64  `json:"startTime"`
+	EndTime   *float64 `json:"endTime,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Img       string   `json:"img,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	TOC       *bool    `json:"toc,omitempty"`
+}
+
+// ReadChaptersFromPodcastJSON parses Podcasting 2.0 JSON chapters into a
+// FFProbeOutput. The chapter title, image and URL are stored in chapter tags
+// "title", "img" and "url", respectively. Chapters marked with "toc": false
+// are not meant to be listed, and are ignored. The top-level title, author and
+// podcastName are stored in format tags "title", "artist" and "album". A
+// chapter without endTime ends where the next one starts, or at 'duration'.
+func ReadChaptersFromPodcastJSON(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	var doc podcastChapters
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return FFProbeOutput{}, fmt.Errorf("podcast chapters: %w", err)
+	}
+
+	var entries []chapterEntry
+	for _, ch := range doc.Chapters {
+		if ch.TOC != nil && !*ch.TOC {
+			continue
+		}
+		if n := len(entries); n > 0 && secondsToDuration(ch.StartTime) <= entries[n-1].start {
+			return FFProbeOutput{}, fmt.Errorf("podcast chapters: chapter at %v is not after the previous one", ch.StartTime)
+		}
+		e := chapterEntry{start: secondsToDuration(ch.StartTime), tags: map[string]string{}}
+		if ch.EndTime != nil {
+			e.end, e.hasEnd = secondsToDuration(*ch.EndTime), true
+		}
+		setTagIfNonEmpty(e.tags, "title", ch.Title)
+		setTagIfNonEmpty(e.tags, "img", ch.Img)
+		setTagIfNonEmpty(e.tags, "url", ch.URL)
+		entries = append(entries, e)
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return FFProbeOutput{}, fmt.Errorf("podcast chapters: %w", err)
+	}
+	var out FFProbeOutput
+	out.Format.Tags = map[string]string{}
+	setTagIfNonEmpty(out.Format.Tags, "title", doc.Title)
+	setTagIfNonEmpty(out.Format.Tags, "artist", doc.Author)
+	setTagIfNonEmpty(out.Format.Tags, "album", doc.PodcastName)
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+// WritePodcastJSON writes the chapters as Podcasting 2.0 JSON chapters. The
+// chapter tags "title", "img" and "url" are written into the corresponding
+// fields; the format tags "title", "artist" and "album" into the top-level
+// title, author and podcastName.
+func WritePodcastJSON(w io.Writer, tags map[string]string, chapters []Chapter) error {
+	doc := podcastChapters{
+		Version:     "1.2.0",
+		Title:       tags["title"],
+		Author:      tags["artist"],
+		PodcastName: tags["album"],
+		Chapters:    make([]podcastChapter, 0, len(chapters)),
+	}
+	for _, ch := range chapters {
+		end := ch.EndOffset().Seconds()
+		doc.Chapters = append(doc.Chapters, podcastChapter{
+			StartTime: ch.StartOffset().Seconds(),
+			EndTime:   &end,
+			Title:     ch.Tags["title"],
+			Img:       ch.Tags["img"],
+			URL:       ch.Tags["url"],
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// The XML namespace of Podlove Simple Chapters
+const pscNamespace = "http://podlove.org/simple-chapters"
+
+// ReadChaptersFromPSC parses Podlove Simple Chapters into a FFProbeOutput. The
+// input may be a standalone <psc:chapters> document, or e.g. an RSS feed
+// containing one, in which case the first <psc:chapters> element is used. The
+// title, image and href attributes are stored in chapter tags "title", "img"
+// and "url", respectively. Each chapter ends where the next one starts; the
+// last one ends at 'duration'.
+func ReadChaptersFromPSC(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	dec := xml.NewDecoder(r)
+	var entries []chapterEntry
+	inChapters := false
+loop:
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return FFProbeOutput{}, fmt.Errorf("podlove chapters: %w", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			if el.Name.Space != pscNamespace {
+				continue
+			}
+			switch el.Name.Local {
+			case "chapters":
+				inChapters = true
+			case "chapter":
+				if !inChapters {
+					continue
+				}
+				e := chapterEntry{tags: map[string]string{}}
+				hasStart := false
+				for _, attr := range el.Attr {
+					switch attr.Name.Local {
+					case "start":
+						if e.start, err = parseNormalPlayTime(attr.Value); err != nil {
+							return FFProbeOutput{}, fmt.Errorf("podlove chapters: %w", err)
+						}
+						hasStart = true
+					case "title":
+						setTagIfNonEmpty(e.tags, "title", attr.Value)
+					case "image":
+						setTagIfNonEmpty(e.tags, "img", attr.Value)
+					case "href":
+						setTagIfNonEmpty(e.tags, "url", attr.Value)
+					}
+				}
+				if !hasStart {
+					return FFProbeOutput{}, fmt.Errorf("podlove chapters: chapter without start")
+				}
+				entries = append(entries, e)
+			}
+		case xml.EndElement:
+			if inChapters && el.Name.Space == pscNamespace && el.Name.Local == "chapters" {
+				break loop
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return FFProbeOutput{}, fmt.Errorf("podlove chapters: no chapters found")
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return FFProbeOutput{}, fmt.Errorf("podlove chapters: %w", err)
+	}
+	var out FFProbeOutput
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+// WritePSC writes the chapters as a Podlove Simple Chapters document. The
+// chapter tags "title", "img" and "url" are written into the title, image and
+// href attributes. The format only stores chapter start times.
+func WritePSC(w io.Writer, chapters []Chapter) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	root := xml.StartElement{
+		Name: xml.Name{Local: "psc:chapters"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "version"}, Value: "1.2"},
+			{Name: xml.Name{Local: "xmlns:psc"}, Value: pscNamespace},
+		},
+	}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	for _, ch := range chapters {
+		el := xml.StartElement{
+			Name: xml.Name{Local: "psc:chapter"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "start"}, Value: formatNormalPlayTime(ch.StartOffset())}},
+		}
+		for _, a := range []struct{ attr, tag string }{{"title", "title"}, {"href", "url"}, {"image", "img"}} {
+			if v := ch.Tags[a.tag]; v != "" {
+				el.Attr = append(el.Attr, xml.Attr{Name: xml.Name{Local: a.attr}, Value: v})
+			}
+		}
+		if err := enc.EncodeToken(el); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(el.End()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Parses Normal Play Time as used by PSC, i.e. [[HH:]MM:]SS[.mmm]
+func parseNormalPlayTime(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var d time.Duration
+	for i, p := range parts {
+		if i == len(parts)-1 {
+			sec, err := parseSeconds(p)
+			if err != nil || sec < 0 || (len(parts) > 1 && sec >= time.Minute) {
+				return 0, fmt.Errorf("invalid timestamp %q", s)
+			}
+			return d*time.Minute + sec, nil
+		}
+		var n int
+		if _, err := fmt.Sscanf(p, "%d", &n); err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		// hours and minutes are both converted into minutes
+		d = d*60 + time.Duration(n)
+	}
+	return d, nil
+}
+
+// Formats duration like "01:02:03.450"
+func formatNormalPlayTime(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", d/time.Hour, d%time.Hour/time.Minute,
+		d%time.Minute/time.Second, d%time.Second/time.Millisecond)
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Round(s * float64(time.Second)))
+}
+
+func setTagIfNonEmpty(tags map[string]string, key, value string) {
+	if value != "" {
+		tags[key] = value
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of the progress of a single ffmpeg process, as
+// reported via its -progress output.
+type Progress struct {
+	// How much of the output has been written, in terms of audio duration.
+	OutTime time.Duration
+	// Processing speed relative to real time, e.g. 30 means 30x. Zero if unknown.
+	Speed float64
+	// Set on the final report.
+	Done bool
+}
+
+// progressParser is an io.Writer consuming the key=value lines produced by
+// ffmpeg -progress. A complete report ends with a "progress" key, upon which
+// the callback is invoked.
+type progressParser struct {
+	buf      []byte
+	cur      Progress
+	onReport func(Progress)
+}
+
+func (p *progressParser) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.parseLine(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *progressParser) parseLine(line string) {
+	key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+	if !ok {
+		return
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "out_time_us", "out_time_ms":
+		// despite its name, out_time_ms is in microseconds as well; older
+		// versions of ffmpeg only report that one
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.cur.OutTime = time.Duration(us) * time.Microsecond
+		}
+	case "speed":
+		// e.g. "31.4x", or "N/A" early on
+		if f, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+			p.cur.Speed = f
+		}
+	case "progress":
+		p.cur.Done = value == "end"
+		if p.onReport != nil {
+			p.onReport(p.cur)
+		}
+	}
+}
+
+// stallWatchdog invokes 'kill' if no progress has been reported for longer
+// than 'timeout'. The initial startup of ffmpeg counts as progress.
+type stallWatchdog struct {
+	mu          sync.Mutex
+	timeout     time.Duration
+	lastOutTime time.Duration
+	lastAdvance time.Time
+	stalled     bool
+	stalledFor  time.Duration
+	done        chan struct{}
+}
+
+func startStallWatchdog(timeout time.Duration, kill func()) *stallWatchdog {
+	w := &stallWatchdog{timeout: timeout, lastAdvance: time.Now(), done: make(chan struct{})}
+	if timeout <= 0 {
+		return w
+	}
+	interval := timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				w.mu.Lock()
+				sinceAdvance := time.Since(w.lastAdvance)
+				stalled := sinceAdvance > w.timeout
+				w.stalled, w.stalledFor = stalled, sinceAdvance
+				w.mu.Unlock()
+				if stalled {
+					kill()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// report registers a progress report; only advancing output time counts.
+func (w *stallWatchdog) report(p Progress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p.OutTime > w.lastOutTime {
+		w.lastOutTime = p.OutTime
+		w.lastAdvance = time.Now()
+	}
+}
+
+// stop terminates the watchdog, and tells whether it detected a stall, and
+// for how long the progress had not advanced at that point.
+func (w *stallWatchdog) stop() (stalled bool, stalledFor, lastOutTime time.Duration) {
+	close(w.done)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stalled, w.stalledFor, w.lastOutTime
+}
+
+// ProgressUpdate is delivered to Observer.OnProgress() whenever an ffmpeg
+// process reports progress, or a WorkItem finishes.
+type ProgressUpdate struct {
+	Item     *WorkItem
+	Progress Progress
+	// Aggregated progress of all WorkItems; only filled in by ProcessWithContext().
+	Overall PoolProgress
+}
+
+// PoolProgress is the aggregated progress of all WorkItems processed by
+// ProcessWithContext(), measured in audio duration.
+type PoolProgress struct {
+	// Audio processed so far; finished items (including failed and skipped
+	// ones) count with their full duration.
+	Processed time.Duration
+	// Total audio duration of all the WorkItems
+	Total time.Duration
+	// Processed / Total, in range [0, 100]
+	Percent float64
+	// Wall time since processing started
+	Elapsed time.Duration
+	// Estimated wall time until all items have been processed; 0 if unknown.
+	ETA time.Duration
+}
+
+// Keeps track of the progress of each WorkItem in the pool and produces
+// aggregated progress updates. The callback invocations are serialized.
+type progressAggregator struct {
+	mu        sync.Mutex
+	started   time.Time
+	total     time.Duration
+	processed map[*WorkItem]time.Duration
+	// audio of the skipped items, which took no time to process
+	skipped  time.Duration
+	callback func(ProgressUpdate)
+}
+
+func newProgressAggregator(workItems []WorkItem, callback func(ProgressUpdate)) *progressAggregator {
+	a := &progressAggregator{
+		started:   time.Now(),
+		processed: make(map[*WorkItem]time.Duration),
+		callback:  callback,
+	}
+	for i := range workItems {
+		a.total += workItems[i].Chapter.Duration()
+	}
+	return a
+}
+
+// Registers a progress report from the item.
+func (a *progressAggregator) update(wi *WorkItem, p Progress) {
+	if a.callback == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	processed := p.OutTime
+	if d := wi.Chapter.Duration(); processed > d || p.Done {
+		processed = d
+	}
+	a.processed[wi] = processed
+	a.callback(ProgressUpdate{Item: wi, Progress: p, Overall: a.overall()})
+}
+
+// Marks the item as completely processed, whatever the outcome. Skipped
+// items are left out of the ETA estimate.
+func (a *progressAggregator) finish(wi *WorkItem, skipped bool) {
+	if skipped {
+		a.mu.Lock()
+		a.skipped += wi.Chapter.Duration()
+		a.mu.Unlock()
+	}
+	a.update(wi, Progress{OutTime: wi.Chapter.Duration(), Done: true})
+}
+
+func (a *progressAggregator) overall() PoolProgress {
+	var processed time.Duration
+	for _, d := range a.processed {
+		processed += d
+	}
+	pp := PoolProgress{
+		Processed: processed,
+		Total:     a.total,
+		Elapsed:   time.Since(a.started),
+	}
+	if a.total > 0 {
+		pp.Percent = 100 * float64(processed) / float64(a.total)
+	}
+	// the rate is based on the audio that was actually extracted
+	if worked := processed - a.skipped; worked > 0 && processed < a.total {
+		rate := float64(pp.Elapsed) / float64(worked)
+		pp.ETA = time.Duration(rate * float64(a.total-processed))
+	}
+	return pp
+}
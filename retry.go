@@ -0,0 +1,107 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// RetryPolicy determines whether and how failed WorkItems are re-run.
+type RetryPolicy struct {
+	// Maximum number of times a WorkItem is processed. Values <= 1 disable
+	// retrying.
+	MaxAttempts int
+
+	// Wait time before the first retry. The wait time is doubled for each
+	// subsequent retry, up to MaxBackoff (if > 0).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Tells whether a failure is worth retrying. If nil, IsRetryable() is used.
+	Retryable func(error) bool
+}
+
+// IsRetryable tells whether the processing error might be transient, i.e.
+// whether re-running the WorkItem could succeed. Cancellation, skipped items,
+// existing output files, permission errors and invalid input data are not
+// considered retryable; other ffmpeg failures, timeouts and stalls are.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrSkipped),
+		errors.Is(err, fs.ErrExist),
+		errors.Is(err, fs.ErrPermission),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+	var ferr *FFmpegError
+	if errors.As(err, &ferr) && strings.Contains(ferr.Stderr, "Invalid data found") {
+		return false
+	}
+	return true
+}
+
+// Computes the wait time before the given retry (1 for the first retry).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// Processes the WorkItem according to the retry policy in opts. Returns the
+// stderr output and exit code of the last attempt, the number of attempts
+// made, and the error of the last attempt.
+func (wi WorkItem) processWithRetries(ctx context.Context, opts ProcessOpts) (string, int, int, error) {
+	policy := opts.Retry
+	attempt := 1
+	for {
+		stderr, exitCode, err := wi.process(ctx, opts)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.retryable(err) {
+			return stderr, exitCode, attempt, err
+		}
+		// ffmpeg output is removed on failure; make sure no leftovers
+		// remain from the failed attempt regardless.
+		os.Remove(wi.partialOutpath())
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return stderr, exitCode, attempt, err
+		case <-timer.C:
+		}
+		attempt++
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// Cmd describes an external command (ffmpeg or ffprobe) to be run.
+type Cmd struct {
+	// Program to run, e.g. "ffmpeg"
+	Name string
+	// Arguments, not including the program name
+	Args []string
+	// Where to write the standard output and error of the program; may be nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Runner runs external commands. Run blocks until the command has finished,
+// and should return an error if the command failed. The error should
+// implement 'ExitCode() int' (as *exec.ExitError does) if the exit code is
+// known. If ctx is cancelled, the command should be killed.
+type Runner interface {
+	Run(ctx context.Context, cmd Cmd) error
+}
+
+// ExecRunner runs the commands as subprocesses via os/exec. This is the
+// default Runner.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, cmd Cmd) error {
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+	return c.Run()
+}
+
+// PrefixRunner runs the commands prefixed with another command, such as
+// "nice -n 19" or "docker exec mycontainer". If Runner is nil, ExecRunner
+// is used.
+type PrefixRunner struct {
+	Prefix []string
+	Runner Runner
+}
+
+func (r PrefixRunner) Run(ctx context.Context, cmd Cmd) error {
+	return runnerOrDefault(r.Runner).Run(ctx, r.prefixed(cmd))
+}
+
+func (r PrefixRunner) prefixed(cmd Cmd) Cmd {
+	if len(r.Prefix) > 0 {
+		args := append(append([]string{}, r.Prefix[1:]...), cmd.Name)
+		cmd.Name, cmd.Args = r.Prefix[0], append(args, cmd.Args...)
+	}
+	return cmd
+}
+
+// Returns the command as it would be run by the runner, as far as that can
+// be known; i.e. with the prefixes of any PrefixRunners applied.
+func commandFor(r Runner, cmd Cmd) Cmd {
+	for {
+		switch pr := r.(type) {
+		case PrefixRunner:
+			cmd, r = pr.prefixed(cmd), pr.Runner
+		case *PrefixRunner:
+			if pr == nil {
+				return cmd
+			}
+			cmd, r = pr.prefixed(cmd), pr.Runner
+		default:
+			return cmd
+		}
+	}
+}
+
+// RecordingRunner records the commands instead of running them, which is
+// useful for testing. If Handler is set, it is called to simulate each
+// command, e.g. by writing canned output into cmd.Stdout; its return value is
+// returned from Run.
+type RecordingRunner struct {
+	Handler func(ctx context.Context, cmd Cmd) error
+
+	mu   sync.Mutex
+	cmds []Cmd
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, cmd Cmd) error {
+	r.mu.Lock()
+	r.cmds = append(r.cmds, cmd)
+	r.mu.Unlock()
+	if r.Handler != nil {
+		return r.Handler(ctx, cmd)
+	}
+	return nil
+}
+
+// Commands returns the commands run so far.
+func (r *RecordingRunner) Commands() []Cmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Cmd(nil), r.cmds...)
+}
+
+func runnerOrDefault(r Runner) Runner {
+	if r == nil {
+		return ExecRunner{}
+	}
+	return r
+}
+
+// Extracts the exit code from the error returned by Runner.Run, or -1 if unknown.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ec interface{ ExitCode() int }
+	if errors.As(err, &ec) {
+		return ec.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// SanitizeProfile determines which characters are allowed in output file names.
+type SanitizeProfile int
+
+const (
+	// SanitizePOSIX replaces only path separators and NUL characters.
+	SanitizePOSIX SanitizeProfile = iota
+	// SanitizeWindows additionally replaces characters not allowed on
+	// Windows, FAT or exFAT file systems, strips trailing dots and spaces,
+	// and avoids reserved device names such as "CON".
+	SanitizeWindows
+	// SanitizeASCII applies SanitizeWindows rules and transliterates the
+	// result into ASCII, replacing characters with no transliteration.
+	SanitizeASCII
+)
+
+// DefaultMaxNameBytes is the maximum file name length on most file systems.
+const DefaultMaxNameBytes = 255
+
+// ParseSanitizeProfile converts the strings "posix", "windows" and "ascii"
+// into SanitizeProfile.
+func ParseSanitizeProfile(s string) (SanitizeProfile, error) {
+	switch strings.ToLower(s) {
+	case "posix":
+		return SanitizePOSIX, nil
+	case "windows", "fat", "exfat":
+		return SanitizeWindows, nil
+	case "ascii":
+		return SanitizeASCII, nil
+	}
+	return 0, fmt.Errorf("invalid sanitize profile %q (expected posix, windows or ascii)", s)
+}
+
+// Tells whether file names differing only by case refer to the same file.
+func (p SanitizeProfile) caseInsensitive() bool {
+	return p != SanitizePOSIX
+}
+
+// SanitizeName makes string 's' usable as (a part of) a single file name
+// component according to the profile. Path separators are always replaced,
+// so the result never introduces subdirectories.
+func SanitizeName(s string, profile SanitizeProfile) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == 0:
+			continue
+		case r == '/':
+			sb.WriteByte('_')
+		case profile == SanitizePOSIX:
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"\|?*`, r):
+			sb.WriteByte('_')
+		case profile == SanitizeASCII && r >= utf8.RuneSelf:
+			if tr, ok := transliterations[r]; ok {
+				sb.WriteString(tr)
+			} else {
+				sb.WriteByte('_')
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Applies the rules concerning whole path components to each component of
+// the relative path 'name', and truncates the final component to at most
+// 'maxBytes' bytes while preserving 'tail' (which must be a suffix of name,
+// typically the extension).
+func finalizeName(name, tail string, profile SanitizeProfile, maxBytes int) string {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxNameBytes
+	}
+	if !strings.HasSuffix(name, tail) {
+		tail = ""
+	}
+	components := strings.Split(name, "/")
+	for i, c := range components {
+		last := i == len(components)-1
+		base := c
+		if last {
+			base = strings.TrimSuffix(c, tail)
+		} else {
+			base = truncateUTF8(c, maxBytes)
+		}
+		if profile != SanitizePOSIX {
+			base = strings.TrimRight(base, ". ")
+			stem := strings.ToUpper(strings.SplitN(base+tail, ".", 2)[0])
+			if windowsReserved[strings.TrimSpace(stem)] {
+				base = "_" + base
+			}
+		}
+		if last {
+			base = truncateUTF8(base, maxBytes-len(tail))
+			c = base + tail
+		} else {
+			c = base
+		}
+		if c == "" || c == "." || c == ".." {
+			c = "_" + c
+		}
+		components[i] = c
+	}
+	return path.Join(components...)
+}
+
+// Shortens string to at most 'max' bytes without splitting multi-byte characters.
+func truncateUTF8(s string, max int) string {
+	if max < 0 {
+		max = 0
+	}
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// Inserts a disambiguating suffix into name, before 'tail'.
+func disambiguateName(name, tail string, n int, profile SanitizeProfile, maxBytes int) string {
+	suffix := fmt.Sprintf(" (%d)", n)
+	return finalizeName(strings.TrimSuffix(name, tail)+suffix+tail, suffix+tail, profile, maxBytes)
+}
+
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Transliterations for the most common non-ASCII characters in latin scripts.
+var transliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE",
+	'Ç': "C", 'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I",
+	'Î': "I", 'Ï': "I", 'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O",
+	'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U",
+	'Ý': "Y", 'Þ': "Th", 'ß': "ss", 'à': "a", 'á': "a", 'â': "a", 'ã': "a",
+	'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c", 'è': "e", 'é': "e", 'ê': "e",
+	'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ð': "d", 'ñ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ù': "u",
+	'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Ā': "A", 'ā': "a", 'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c", 'Č': "C",
+	'č': "c", 'Ď': "D", 'ď': "d", 'Đ': "D", 'đ': "d", 'Ē': "E", 'ē': "e",
+	'Ę': "E", 'ę': "e", 'Ě': "E", 'ě': "e", 'Ğ': "G", 'ğ': "g", 'Ī': "I",
+	'ī': "i", 'İ': "I", 'ı': "i", 'Ł': "L", 'ł': "l", 'Ń': "N", 'ń': "n",
+	'Ň': "N", 'ň': "n", 'Ō': "O", 'ō': "o", 'Ő': "O", 'ő': "o", 'Œ': "OE",
+	'œ': "oe", 'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ť': "T", 'ť': "t", 'Ū': "U", 'ū': "u", 'Ů': "U",
+	'ů': "u", 'Ű': "U", 'ű': "u", 'Ÿ': "Y", 'Ź': "Z", 'ź': "z", 'Ż': "Z",
+	'ż': "z", 'Ž': "Z", 'ž': "z",
+	'‘': "'", '’': "'", '‚': "'", '“': "'", '”': "'", '„': "'",
+	'«': "'", '»': "'", '–': "-", '—': "-", '…': "...", '\u00a0': " ",
+}
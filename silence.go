@@ -0,0 +1,228 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Silence represents a period of silence detected in the input file.
+type Silence struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// SilenceDetectOpts specifies how silences are detected, and how the detected
+// silences are turned into chapters.
+type SilenceDetectOpts struct {
+	// Audio quieter than this (in dB) is considered silence.
+	NoiseThreshold float64
+
+	// Silences shorter than this are ignored.
+	MinSilence time.Duration
+
+	// Do not produce chapters shorter than this; silences that would cause
+	// such chapters are not used as cut points.
+	MinChapter time.Duration
+
+	// If a chapter would become longer than this, it is forcibly cut at this
+	// length even if no silence is found. Set to 0 to disable.
+	MaxChapter time.Duration
+
+	// Runs the ffmpeg command; ExecRunner if nil.
+	Runner Runner
+
+	// Path to the ffmpeg binary. If empty, it is looked up from $PATH.
+	FFmpegPath string
+}
+
+// DefaultSilenceDetectOpts returns some sensible set of default values for SilenceDetectOpts.
+func DefaultSilenceDetectOpts() SilenceDetectOpts {
+	var opts SilenceDetectOpts
+	opts.NoiseThreshold = -30
+	opts.MinSilence = 2 * time.Second
+	opts.MinChapter = 60 * time.Second
+	opts.MaxChapter = 0
+	return opts
+}
+
+// GetSilenceDetectCommandline builds the list of arguments used for detecting
+// silences in file 'infile' via 'ffmpeg'. Only useful for debug purposes.
+func GetSilenceDetectCommandline(infile string, opts SilenceDetectOpts) []string {
+	filter := fmt.Sprintf("silencedetect=noise=%gdB:d=%g", opts.NoiseThreshold, opts.MinSilence.Seconds())
+	return []string{
+		"-nostdin",
+		"-hide_banner",
+		"-nostats",
+		"-i", infile,
+		"-vn",
+		"-af", filter,
+		"-f", "null",
+		"-",
+	}
+}
+
+// DetectSilence is an alias for DetectSilenceWithContext(context.Background(), infile, opts)
+func DetectSilence(infile string, opts SilenceDetectOpts) ([]Silence, error) {
+	return DetectSilenceWithContext(context.Background(), infile, opts)
+}
+
+// DetectSilenceWithContext runs ffmpeg silencedetect filter on the whole
+// file 'infile' and returns the detected silences. Note that this decodes
+// the whole audio stream, which may take a while for long inputs.
+//
+// Unless a Runner or a path is given, expects the program 'ffmpeg' to be
+// somewhere in user's $PATH.
+func DetectSilenceWithContext(ctx context.Context, infile string, opts SilenceDetectOpts) ([]Silence, error) {
+	// silencedetect reports its findings in the log output
+	var stderr bytes.Buffer
+	cmd := Cmd{Name: binaryOrDefault(opts.FFmpegPath, "ffmpeg"), Args: GetSilenceDetectCommandline(infile, opts), Stderr: &stderr}
+
+	if err := runnerOrDefault(opts.Runner).Run(ctx, cmd); err != nil {
+		msg := strings.Trim(stderr.String(), "\n")
+		if msg != "" {
+			return nil, fmt.Errorf("ffmpeg error: %s: %w", lastLine(msg), err)
+		}
+		return nil, fmt.Errorf("ffmpeg error: %w", err)
+	}
+
+	return ParseSilenceDetectOutput(&stderr)
+}
+
+var (
+	reSilenceStart = regexp.MustCompile(`silence_start:\s*(-?[0-9.]+)`)
+	reSilenceEnd   = regexp.MustCompile(`silence_end:\s*(-?[0-9.]+)`)
+)
+
+// ParseSilenceDetectOutput parses the log output of ffmpeg silencedetect
+// filter. Lines not produced by the filter are ignored. A silence that has
+// not ended by the end of the output (i.e. silence at the very end of the
+// file) is discarded, as it is of no use for chapter synthesis.
+func ParseSilenceDetectOutput(r io.Reader) ([]Silence, error) {
+	var silences []Silence
+	var start time.Duration
+	open := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := reSilenceStart.FindStringSubmatch(line); m != nil {
+			ts, err := parseSeconds(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_start in %q: %w", line, err)
+			}
+			if ts < 0 {
+				ts = 0
+			}
+			start, open = ts, true
+		} else if m := reSilenceEnd.FindStringSubmatch(line); m != nil {
+			ts, err := parseSeconds(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_end in %q: %w", line, err)
+			}
+			if !open {
+				continue
+			}
+			silences = append(silences, Silence{Start: start, End: ts})
+			open = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
+// ChaptersFromSilences synthesizes chapters from the given silences. Each
+// chapter boundary is placed in the middle of a silence, subject to the
+// minimum and maximum chapter lengths in 'opts'. The chapters cover the whole
+// range [0, duration).
+func ChaptersFromSilences(silences []Silence, duration time.Duration, opts SilenceDetectOpts) []Chapter {
+	var cuts []time.Duration
+	var last time.Duration
+
+	forceCuts := func(until time.Duration) {
+		if opts.MaxChapter <= 0 {
+			return
+		}
+		for until-last > opts.MaxChapter {
+			last += opts.MaxChapter
+			cuts = append(cuts, last)
+		}
+	}
+
+	for _, s := range silences {
+		cut := s.Start + (s.End-s.Start)/2
+		if cut >= duration {
+			break
+		}
+		forceCuts(cut)
+		if cut-last < opts.MinChapter || duration-cut < opts.MinChapter {
+			continue
+		}
+		cuts = append(cuts, cut)
+		last = cut
+	}
+	forceCuts(duration)
+
+	return chaptersFromCutPoints(cuts, duration, "")
+}
+
+// ReadChaptersFromSilenceWithContext detects silences in 'infile' and
+// synthesizes chapters from them. The result can be used in place of the
+// chapters read by ffprobe, see InputFileMetadata.ReplaceChapters().
+func ReadChaptersFromSilenceWithContext(ctx context.Context, infile string, duration time.Duration, opts SilenceDetectOpts) (FFProbeOutput, error) {
+	if duration <= 0 {
+		return FFProbeOutput{}, fmt.Errorf("cannot synthesize chapters: unknown input duration")
+	}
+	silences, err := DetectSilenceWithContext(ctx, infile, opts)
+	if err != nil {
+		return FFProbeOutput{}, err
+	}
+	var out FFProbeOutput
+	out.SetChapters(ChaptersFromSilences(silences, duration, opts))
+	return out, nil
+}
+
+// Builds consecutive chapters covering [0, duration), split at 'cuts' (which
+// must be in ascending order). If 'titleFormat' is non-empty, it is used for
+// generating chapter titles with the 1-based chapter number as argument.
+func chaptersFromCutPoints(cuts []time.Duration, duration time.Duration, titleFormat string) []Chapter {
+	bounds := append([]time.Duration{0}, cuts...)
+	bounds = append(bounds, duration)
+
+	chapters := make([]Chapter, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		var title string
+		if titleFormat != "" {
+			title = fmt.Sprintf(titleFormat, i+1)
+		}
+		chapters = append(chapters, NewChapter(i, bounds[i], bounds[i+1], title))
+	}
+	return chapters
+}
+
+// Returns the last non-empty line of a multi-line string.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"fmt"
+	"time"
+)
+
+// FixedSplitOpts specifies how to split the input file into synthetic
+// chapters without regard to the actual content.
+type FixedSplitOpts struct {
+	// Split into this many parts of equal length. Mutually exclusive with Every.
+	Count int
+
+	// Split into parts of this length; the last part may be shorter.
+	// Mutually exclusive with Count.
+	Every time.Duration
+
+	// If positive, each cut point is moved to the middle of the nearest
+	// silence within this distance, if there is one. Requires the silences
+	// to be passed to FixedChapters().
+	SnapWindow time.Duration
+
+	// Format for the generated chapter titles, taking the 1-based part number
+	// as argument. Defaults to "Part %d".
+	TitleFormat string
+}
+
+// FixedChapters generates synthetic chapters covering [0, duration), according
+// to 'opts'. The silences are only used if opts.SnapWindow is positive, in
+// which case they can be produced with DetectSilence().
+func FixedChapters(duration time.Duration, opts FixedSplitOpts, silences []Silence) ([]Chapter, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("cannot split: unknown input duration")
+	}
+
+	var step time.Duration
+	switch {
+	case opts.Count > 0 && opts.Every > 0:
+		return nil, fmt.Errorf("cannot split both by count and by duration")
+	case opts.Count > 0:
+		step = duration / time.Duration(opts.Count)
+	case opts.Every > 0:
+		step = opts.Every
+	default:
+		return nil, fmt.Errorf("either part count or part duration must be positive")
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("too many parts for input duration %v", duration)
+	}
+
+	var cuts []time.Duration
+	last := time.Duration(0)
+	for i := 1; ; i++ {
+		cut := time.Duration(i) * step
+		if (opts.Count > 0 && i >= opts.Count) || cut >= duration {
+			break
+		}
+		if opts.SnapWindow > 0 {
+			// stay between the neighbouring cuts, so that the chapters
+			// remain in order even if the window is wider than half a step
+			next := time.Duration(i+1) * step
+			if next > duration {
+				next = duration
+			}
+			cut = snapToSilence(cut, last, next, opts.SnapWindow, silences)
+		}
+		if cut <= last {
+			continue
+		}
+		cuts = append(cuts, cut)
+		last = cut
+	}
+
+	titleFormat := opts.TitleFormat
+	if titleFormat == "" {
+		titleFormat = "Part %d"
+	}
+	return chaptersFromCutPoints(cuts, duration, titleFormat), nil
+}
+
+// Returns the middle point of the silence nearest to 'cut', if it is within
+// 'window' and stays within (after, before). Otherwise returns 'cut' as-is.
+func snapToSilence(cut, after, before, window time.Duration, silences []Silence) time.Duration {
+	best := cut
+	bestDist := window + 1
+	for _, s := range silences {
+		mid := s.Start + (s.End-s.Start)/2
+		if mid <= after || mid >= before {
+			continue
+		}
+		dist := mid - cut
+		if dist < 0 {
+			dist = -dist
+		}
+		if dist <= window && dist < bestDist {
+			best, bestDist = mid, dist
+		}
+	}
+	return best
+}
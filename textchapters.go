@@ -0,0 +1,139 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const textTimestamp = `(\d{1,3}(?::\d{1,2}){1,2}(?:[.,]\d{1,3})?)`
+
+var (
+	// e.g. "0:00 Prologue", "- [12:34] - Chapter 1", "1:02:03.500<TAB>Chapter 2"
+	reTextLeadingTimestamp = regexp.MustCompile(`^(?:[-*•]\s*)?[\[(]?` + textTimestamp + `[\])]?(?:\s*[-–—:|]\s|\s|$)\s*(.*)$`)
+	// e.g. "Prologue - 0:00", "Chapter 1 (12:34)"
+	reTextTrailingTimestamp = regexp.MustCompile(`^(?:[-*•]\s*)?(.*?)(?:\s[-–—:|])?\s+[\[(]?` + textTimestamp + `[\])]?$`)
+)
+
+var errNoTimestamps = errors.New("chapter list: no timestamps found")
+
+// ReadChaptersFromText parses a plain-text chapter list, such as those found
+// in video descriptions or on publisher websites, into a FFProbeOutput. Each
+// line containing a timestamp, either at the beginning or at the end of the
+// line, starts a chapter; the rest of the line is the chapter title. Other
+// lines (e.g. headings) are ignored. Timestamps are of the form h:mm:ss or
+// mm:ss, optionally followed by milliseconds (".500" or ",500"). The title may
+// be separated from the timestamp with whitespace, or with a separator such
+// as " - " or "|".
+//
+// Each chapter ends where the next one starts; the last one ends at
+// 'duration', which should be the total duration of the audio file.
+func ReadChaptersFromText(r io.Reader, duration time.Duration) (FFProbeOutput, error) {
+	var entries []chapterEntry
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if lineno == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" {
+			continue
+		}
+		var ts, title string
+		if m := reTextLeadingTimestamp.FindStringSubmatch(line); m != nil {
+			ts, title = m[1], m[2]
+		} else if m := reTextTrailingTimestamp.FindStringSubmatch(line); m != nil {
+			title, ts = m[1], m[2]
+		} else {
+			continue
+		}
+		start, err := parseTextTimestamp(ts)
+		if err != nil {
+			return FFProbeOutput{}, fmt.Errorf("chapter list line %d: %w", lineno, err)
+		}
+		if n := len(entries); n > 0 && start <= entries[n-1].start {
+			return FFProbeOutput{}, fmt.Errorf("chapter list line %d: timestamp %s is not after the previous one", lineno, ts)
+		}
+		e := chapterEntry{start: start, tags: map[string]string{}}
+		if title = strings.TrimSpace(title); title != "" {
+			e.tags["title"] = title
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return FFProbeOutput{}, err
+	}
+	if len(entries) == 0 {
+		return FFProbeOutput{}, errNoTimestamps
+	}
+
+	chapters, err := chaptersFromEntries(entries, duration)
+	if err != nil {
+		return FFProbeOutput{}, fmt.Errorf("chapter list: %w", err)
+	}
+	var out FFProbeOutput
+	out.SetChapters(chapters)
+	return out, nil
+}
+
+// Parses timestamp of the form [h:]mm:ss[.mmm]. Without hours, the minutes
+// may exceed 59.
+func parseTextTimestamp(s string) (time.Duration, error) {
+	main, frac, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+	parts := strings.Split(main, ":")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		nums[i] = n
+	}
+
+	var d time.Duration
+	switch len(nums) {
+	case 2:
+		if nums[1] >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d = time.Duration(nums[0])*time.Minute + time.Duration(nums[1])*time.Second
+	case 3:
+		if nums[1] >= 60 || nums[2] >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d = time.Duration(nums[0])*time.Hour + time.Duration(nums[1])*time.Minute + time.Duration(nums[2])*time.Second
+	default:
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	if frac != "" {
+		// ".5" means 500 milliseconds
+		ms, err := strconv.Atoi((frac + "00")[:3])
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d += time.Duration(ms) * time.Millisecond
+	}
+	return d, nil
+}
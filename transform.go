@@ -0,0 +1,207 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MergeDirection specifies into which neighbour a short chapter is merged.
+type MergeDirection int
+
+const (
+	// MergeIntoPrevious merges a short chapter into the preceding chapter. The
+	// first chapter has no predecessor, so it is merged into the next one.
+	MergeIntoPrevious MergeDirection = iota
+	// MergeIntoNext merges a short chapter into the following chapter. The
+	// last chapter has no successor, so it is merged into the previous one.
+	MergeIntoNext
+)
+
+// ParseMergeDirection converts the strings "prev" and "next" into MergeDirection.
+func ParseMergeDirection(s string) (MergeDirection, error) {
+	switch strings.ToLower(s) {
+	case "prev", "previous":
+		return MergeIntoPrevious, nil
+	case "next":
+		return MergeIntoNext, nil
+	}
+	return 0, fmt.Errorf("invalid merge direction %q (expected prev or next)", s)
+}
+
+// MergeTitles specifies what happens to the title of the merged chapter.
+type MergeTitles int
+
+const (
+	// KeepTargetTitle keeps the title of the chapter that is merged into.
+	KeepTargetTitle MergeTitles = iota
+	// ConcatenateTitles joins the titles of all merged chapters, in order.
+	ConcatenateTitles
+)
+
+// ParseMergeTitles converts the strings "keep" and "concat" into MergeTitles.
+func ParseMergeTitles(s string) (MergeTitles, error) {
+	switch strings.ToLower(s) {
+	case "keep":
+		return KeepTargetTitle, nil
+	case "concat", "concatenate":
+		return ConcatenateTitles, nil
+	}
+	return 0, fmt.Errorf("invalid title merge mode %q (expected keep or concat)", s)
+}
+
+// MergeOpts specifies how MergeShortChapters() operates.
+type MergeOpts struct {
+	// Chapters shorter than this are merged into a neighbour.
+	MinDuration time.Duration
+
+	Direction MergeDirection
+	Titles    MergeTitles
+
+	// Placed between titles when using ConcatenateTitles. Defaults to " / ".
+	TitleSeparator string
+}
+
+// MergeShortChapters merges each chapter shorter than opts.MinDuration into
+// its neighbouring chapter. The chapters are expected to be in chronological
+// order. The resulting chapters are renumbered sequentially, starting from
+// the ID of the first chapter.
+func MergeShortChapters(chapters []Chapter, opts MergeOpts) []Chapter {
+	if opts.MinDuration <= 0 || len(chapters) < 2 {
+		return chapters
+	}
+	if opts.TitleSeparator == "" {
+		opts.TitleSeparator = " / "
+	}
+	short := func(ch Chapter) bool {
+		return ch.Duration() < opts.MinDuration
+	}
+
+	// Merging into next is the mirror image of merging into previous, so
+	// the same loop can be used by walking the chapters backwards.
+	order := make([]Chapter, len(chapters))
+	copy(order, chapters)
+	if opts.Direction == MergeIntoNext {
+		reverseChapters(order)
+	}
+
+	var merged []Chapter
+	for _, ch := range order {
+		if len(merged) > 0 && short(ch) {
+			last := len(merged) - 1
+			merged[last] = mergeChapters(merged[last], ch, opts)
+			continue
+		}
+		merged = append(merged, ch)
+	}
+	// The chapter at the edge had no neighbour in the preferred direction
+	if len(merged) > 1 && short(merged[0]) {
+		merged = append([]Chapter{mergeChapters(merged[1], merged[0], opts)}, merged[2:]...)
+	}
+
+	if opts.Direction == MergeIntoNext {
+		reverseChapters(merged)
+	}
+	for i := range merged {
+		merged[i].ID = chapters[0].ID + i
+	}
+	return merged
+}
+
+// Merges chapter 'other' into chapter 'target'. The resulting chapter spans
+// both, and inherits the tags of 'target'.
+func mergeChapters(target, other Chapter, opts MergeOpts) Chapter {
+	first, second := target, other
+	if other.StartOffset() < target.StartOffset() {
+		first, second = other, target
+	}
+
+	res := NewChapter(target.ID, first.StartOffset(), second.EndOffset(), "")
+	for k, v := range target.Tags {
+		res.Tags[k] = v
+	}
+
+	if opts.Titles == ConcatenateTitles {
+		var titles []string
+		for _, ch := range []Chapter{first, second} {
+			if title := ch.Tags["title"]; title != "" {
+				titles = append(titles, title)
+			}
+		}
+		if len(titles) > 0 {
+			res.Tags["title"] = strings.Join(titles, opts.TitleSeparator)
+		}
+	}
+	return res
+}
+
+func reverseChapters(chapters []Chapter) {
+	for i, j := 0, len(chapters)-1; i < j; i, j = i+1, j-1 {
+		chapters[i], chapters[j] = chapters[j], chapters[i]
+	}
+}
+
+// Splits the chapters into groups of consecutive chapters. If 'size' is
+// positive, each group holds (at most) 'size' chapters. Otherwise consecutive
+// chapters whose titles share the same prefix before 'separator' are grouped
+// together.
+func groupChapters(chapters []Chapter, size int, separator string) [][]Chapter {
+	var groups [][]Chapter
+	prevKey := ""
+	for i, ch := range chapters {
+		var newGroup bool
+		if size > 0 {
+			newGroup = i%size == 0
+		} else {
+			key := titlePrefix(ch, separator)
+			newGroup = i == 0 || key != prevKey
+			prevKey = key
+		}
+		if newGroup {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], ch)
+	}
+	return groups
+}
+
+// Builds a chapter spanning all the chapters in the group. When grouping by
+// title prefix, the prefix becomes the title; otherwise the title of the
+// first chapter is used.
+func groupSpan(id int, group []Chapter, separator string) Chapter {
+	first, last := group[0], group[len(group)-1]
+	span := NewChapter(id, first.StartOffset(), last.EndOffset(), "")
+	for k, v := range first.Tags {
+		span.Tags[k] = v
+	}
+	if separator != "" {
+		if prefix := titlePrefix(first, separator); prefix != "" {
+			span.Tags["title"] = prefix
+		}
+	}
+	return span
+}
+
+// Returns the part of the chapter title preceding the separator, or the
+// whole title if it does not contain the separator.
+func titlePrefix(ch Chapter, separator string) string {
+	title := ch.Tags["title"]
+	if i := strings.Index(title, separator); i >= 0 {
+		title = title[:i]
+	}
+	return strings.TrimSpace(title)
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 Markus Holmström (MawKKe)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffmpegsplit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupported is returned by CheckFFmpeg() and CheckFFprobe() if the
+// binary is too old or lacks required features.
+var ErrUnsupported = errors.New("unsupported ffmpeg installation")
+
+// ToolInfo describes an ffmpeg or ffprobe binary.
+type ToolInfo struct {
+	// Path of the binary as given
+	Path string
+	// Version string as reported by the binary, e.g. "4.4.2-0ubuntu0.22.04.1"
+	Version string
+	// Parsed major and minor version; both 0 for development builds such
+	// as "N-109421-g9adf02247c", whose version can not be determined.
+	Major int
+	Minor int
+}
+
+func (t ToolInfo) String() string {
+	return fmt.Sprintf("%s (version %s)", t.Path, t.Version)
+}
+
+// Tells whether the version is at least major.minor. Development builds are
+// assumed to be recent enough.
+func (t ToolInfo) atLeast(major, minor int) bool {
+	if t.Major == 0 && t.Minor == 0 {
+		return true
+	}
+	return t.Major > major || t.Major == major && t.Minor >= minor
+}
+
+// FFmpegRequirements lists the features required from ffmpeg.
+type FFmpegRequirements struct {
+	// Minimum required version
+	MinMajor int
+	MinMinor int
+
+	// Command line options, e.g. "-progress"
+	Options []string
+
+	// Muxers (output formats), demuxers (input formats) and filters, by
+	// their ffmpeg names, e.g. "ipod", "ffmetadata" or "silencedetect".
+	Muxers   []string
+	Demuxers []string
+	Filters  []string
+}
+
+// DefaultFFmpegRequirements returns the requirements for processing
+// WorkItems, not including any format specific requirements.
+func DefaultFFmpegRequirements() FFmpegRequirements {
+	var req FFmpegRequirements
+	req.MinMajor = 4
+	req.MinMinor = 0
+	req.Options = []string{"-progress", "-map_chapters"}
+	return req
+}
+
+// MuxerForExtension returns the name of the muxer ffmpeg uses for output
+// files with the given extension (without the dot), or "" if unknown.
+func MuxerForExtension(ext string) string {
+	return extensionMuxers[strings.ToLower(ext)]
+}
+
+var extensionMuxers = map[string]string{
+	"m4a": "ipod", "m4b": "ipod", "m4v": "ipod", "mp4": "mp4", "mov": "mov",
+	"mp3": "mp3", "aac": "adts", "ogg": "ogg", "oga": "ogg", "opus": "opus",
+	"flac": "flac", "wav": "wav", "mka": "matroska", "mkv": "matroska",
+	"webm": "webm",
+}
+
+var reVersion = regexp.MustCompile(`^n?(\d+)\.(\d+)`)
+
+// ParseVersionOutput parses the output of 'ffmpeg -version' (or ffprobe).
+func ParseVersionOutput(out string) (ToolInfo, error) {
+	line, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "version" {
+		return ToolInfo{}, fmt.Errorf("unexpected version output: %q", line)
+	}
+	info := ToolInfo{Version: fields[2]}
+	if m := reVersion.FindStringSubmatch(info.Version); m != nil {
+		info.Major, _ = strconv.Atoi(m[1])
+		info.Minor, _ = strconv.Atoi(m[2])
+	}
+	return info, nil
+}
+
+// Runs the binary with the given arguments, returning its standard output.
+func runTool(ctx context.Context, runner Runner, path string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := Cmd{Name: path, Args: args, Stdout: &stdout, Stderr: &stderr}
+	if err := runnerOrDefault(runner).Run(ctx, cmd); err != nil {
+		msg := strings.Trim(stderr.String(), "\n")
+		if msg != "" {
+			return "", fmt.Errorf("failed to run %s: %s: %w", path, lastLine(msg), err)
+		}
+		return "", fmt.Errorf("failed to run %s: %w", path, err)
+	}
+	return stdout.String(), nil
+}
+
+// Runs 'path -version' and parses the output.
+func toolInfo(ctx context.Context, runner Runner, path string) (ToolInfo, error) {
+	out, err := runTool(ctx, runner, path, "-hide_banner", "-version")
+	if err != nil {
+		return ToolInfo{}, err
+	}
+	info, err := ParseVersionOutput(out)
+	if err != nil {
+		return ToolInfo{}, fmt.Errorf("%s: %w", path, err)
+	}
+	info.Path = path
+	return info, nil
+}
+
+// CheckFFprobe verifies that ffprobe at 'path' (looked up from $PATH if
+// empty) can be run and is recent enough. Returns an error wrapping
+// ErrUnsupported if it is too old.
+func CheckFFprobe(ctx context.Context, runner Runner, path string) (ToolInfo, error) {
+	info, err := toolInfo(ctx, runner, binaryOrDefault(path, "ffprobe"))
+	if err != nil {
+		return ToolInfo{}, err
+	}
+	req := DefaultFFmpegRequirements()
+	if !info.atLeast(req.MinMajor, req.MinMinor) {
+		return info, fmt.Errorf("%w: %v is too old, version %d.%d or newer is required",
+			ErrUnsupported, info, req.MinMajor, req.MinMinor)
+	}
+	return info, nil
+}
+
+// CheckFFmpeg verifies that ffmpeg at 'path' (looked up from $PATH if empty)
+// can be run and fulfills the requirements. Returns an error wrapping
+// ErrUnsupported listing the missing features, if any.
+func CheckFFmpeg(ctx context.Context, runner Runner, path string, req FFmpegRequirements) (ToolInfo, error) {
+	info, err := toolInfo(ctx, runner, binaryOrDefault(path, "ffmpeg"))
+	if err != nil {
+		return ToolInfo{}, err
+	}
+	if !info.atLeast(req.MinMajor, req.MinMinor) {
+		return info, fmt.Errorf("%w: %v is too old, version %d.%d or newer is required",
+			ErrUnsupported, info, req.MinMajor, req.MinMinor)
+	}
+
+	var missing []string
+	checks := []struct {
+		kind   string
+		names  []string
+		args   []string
+		parser func(string) map[string]bool
+	}{
+		{"option", req.Options, []string{"-h", "long"}, parseOptionList},
+		{"muxer", req.Muxers, []string{"-muxers"}, parseFormatList},
+		{"demuxer", req.Demuxers, []string{"-demuxers"}, parseFormatList},
+		{"filter", req.Filters, []string{"-filters"}, parseFilterList},
+	}
+	for _, c := range checks {
+		if len(c.names) == 0 {
+			continue
+		}
+		out, err := runTool(ctx, runner, info.Path, append([]string{"-hide_banner"}, c.args...)...)
+		if err != nil {
+			return info, err
+		}
+		available := c.parser(out)
+		for _, name := range c.names {
+			if !available[name] {
+				missing = append(missing, fmt.Sprintf("%s %s", c.kind, name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return info, fmt.Errorf("%w: %v lacks required features: %s",
+			ErrUnsupported, info, strings.Join(missing, ", "))
+	}
+	return info, nil
+}
+
+// Parses the output of 'ffmpeg -h long': options are listed at the beginning
+// of lines, e.g. "-progress url        write program-readable progress information"
+func parseOptionList(out string) map[string]bool {
+	options := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+			options[fields[0]] = true
+		}
+	}
+	return options
+}
+
+// Parses the output of 'ffmpeg -muxers' or '-demuxers': after a legend ending
+// with "--", each line lists flags and (comma separated) format names, e.g.
+// " D  mov,mp4,m4a,3gp,3g2,mj2 QuickTime / MOV"
+func parseFormatList(out string) map[string]bool {
+	formats := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	inList := false
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !inList {
+			inList = len(fields) == 1 && fields[0] == "--"
+			continue
+		}
+		if len(fields) >= 2 {
+			for _, name := range strings.Split(fields[1], ",") {
+				formats[name] = true
+			}
+		}
+	}
+	return formats
+}
+
+// Parses the output of 'ffmpeg -filters', where each filter is listed as in
+// " ... silencedetect     A->A       Detect silence."
+func parseFilterList(out string) map[string]bool {
+	filters := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && strings.Contains(fields[2], "->") {
+			filters[fields[1]] = true
+		}
+	}
+	return filters
+}
+
+func binaryOrDefault(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path
+}
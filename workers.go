@@ -15,46 +15,165 @@
 package ffmpegsplit
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"sync"
+	"time"
 )
 
 type job struct {
-	wi *WorkItem
+	index int
+	wi    *WorkItem
 }
 type result struct {
-	wi  *WorkItem
-	err error
+	index int
+	res   Result
 }
 
-// Status describes how many chapter extractions succeeded and how many failed.
-// Note that successful + failed should equal submitted, otherwise an error
-// happened somewhere.
+// Result describes the outcome of processing a single WorkItem.
+type Result struct {
+	WorkItem *WorkItem
+
+	// Full path of the output file
+	Outfile string
+
+	// Audio duration of the WorkItem
+	Duration time.Duration
+
+	// How long the processing took
+	WallTime time.Duration
+
+	// Exit code of ffmpeg; -1 if ffmpeg was not run, or was killed
+	ExitCode int
+
+	// Whatever ffmpeg printed into stderr, on the last attempt
+	Stderr string
+
+	// How many times processing was attempted, see ProcessOpts.Retry
+	Attempts int
+
+	// Non-nil if the processing failed, was skipped (ErrSkipped) or was
+	// cancelled (the context error, or the error caused by cancellation).
+	Err error
+
+	// Processing was skipped due to an existing output file
+	Skipped bool
+
+	// The context was cancelled before or during processing
+	Cancelled bool
+}
+
+// Successful tells whether the output file was produced.
+func (r Result) Successful() bool {
+	return r.Err == nil
+}
+
+// Results is a list of per-WorkItem results, see ProcessWithContext().
+type Results []Result
+
+// Status summarizes the results.
+func (rs Results) Status() Status {
+	s := Status{Submitted: len(rs)}
+	for _, r := range rs {
+		switch {
+		case r.Cancelled:
+			s.Cancelled++
+		case r.Skipped:
+			s.Skipped++
+		case r.Err != nil:
+			s.Failed++
+		default:
+			s.Successful++
+		}
+	}
+	return s
+}
+
+// Status describes how many chapter extractions succeeded, how many were
+// skipped due to existing output files, how many failed, and how many were
+// cancelled (either not started at all, or interrupted while running). Note
+// that successful + skipped + failed + cancelled should equal submitted,
+// otherwise an error happened somewhere.
 type Status struct {
 	Successful int
+	Skipped    int
 	Failed     int
+	Cancelled  int
 	Submitted  int
 }
 
-// Process all workItems, i.e. do the actual extraction process. The workItems
-// contain all the necessary information for the extractions to be performed.
-// The processing happens in parallel, using at most 'maxConcurrent' ffmpeg
-// worker processes.
+// ProcessOpts contains options controlling the parallel processing of WorkItems.
+type ProcessOpts struct {
+	// Maximum number of concurrent ffmpeg processes. Set to <= 0 to use
+	// the number of CPUs.
+	MaxConcurrent int
+
+	// Each ffmpeg process is killed if it has not finished within
+	// TimeoutBase + TimeoutPerAudioHour * (duration of the chapter in hours).
+	// Set both to 0 to disable the timeout.
+	TimeoutBase         time.Duration
+	TimeoutPerAudioHour time.Duration
+
+	// Each ffmpeg process is killed if its progress has not advanced for this
+	// long. Set to 0 to disable stall detection.
+	StallTimeout time.Duration
+
+	// Runs the ffmpeg (and ffprobe) commands; ExecRunner if nil.
+	Runner Runner
+
+	// Path to the ffmpeg and ffprobe binaries. If empty, they are looked
+	// up from $PATH.
+	FFmpegPath  string
+	FFprobePath string
+
+	// Determines whether failed WorkItems are re-run. By default they are not.
+	Retry RetryPolicy
+
+	// If set, receives progress reports and other lifecycle events.
+	Observer Observer
+}
+
+// Computes the timeout for processing the WorkItem, or 0 if there is none.
+func (opts ProcessOpts) itemTimeout(wi WorkItem) time.Duration {
+	if opts.TimeoutBase <= 0 && opts.TimeoutPerAudioHour <= 0 {
+		return 0
+	}
+	hours := wi.Chapter.Duration().Hours()
+	return opts.TimeoutBase + time.Duration(hours*float64(opts.TimeoutPerAudioHour))
+}
+
+// Process is an alias for ProcessWithContext(context.Background(), workItems,
+// ProcessOpts{MaxConcurrent: maxConcurrent}).Status().
+func Process(workItems []WorkItem, maxConcurrent int) Status {
+	return ProcessWithContext(context.Background(), workItems, ProcessOpts{MaxConcurrent: maxConcurrent}).Status()
+}
+
+// ProcessWithContext processes all workItems, i.e. does the actual extraction
+// process. The workItems contain all the necessary information for the
+// extractions to be performed. The processing happens in parallel, using at
+// most opts.MaxConcurrent ffmpeg worker processes. Returns the result of each
+// WorkItem, in the same order as 'workItems'.
+//
+// Cancelling the context kills all running ffmpeg processes and prevents new
+// ones from being started; the affected items are reported as cancelled.
 //
 // Note: the extraction process does not re-encode the audio stream, thus the
 // processing performance is not likely CPU-bound. However, using too many
 // workers extracting the same file may saturate I/O, decreasing overall
-// performance. In summary: increasing 'maxConcurrent' value may improve
+// performance. In summary: increasing 'MaxConcurrent' value may improve
 // performance, but only up to a point.
-//
-// TODO: add similar processin interface with support for context.Context (use
-// exec.CommandContext?)
-func Process(workItems []WorkItem, maxConcurrent int) Status {
+func ProcessWithContext(ctx context.Context, workItems []WorkItem, opts ProcessOpts) Results {
+	maxConcurrent := opts.MaxConcurrent
 	if maxConcurrent <= 0 {
 		maxConcurrent = runtime.NumCPU()
 	}
 
+	obs := newSerialObserver(opts.Observer)
+	progress := newProgressAggregator(workItems, obs.OnProgress)
+	obs.OnPlanned(workItems)
+
 	var wg sync.WaitGroup
 	chJob := make(chan job, len(workItems))
 	chRes := make(chan result, len(workItems))
@@ -63,39 +182,57 @@ func Process(workItems []WorkItem, maxConcurrent int) Status {
 		go func() {
 			defer wg.Done()
 			for job := range chJob {
-				err := job.wi.Process()
-				chRes <- result{job.wi, err}
+				wi := job.wi
+				res := Result{
+					WorkItem: wi,
+					Outfile:  wi.outpath(),
+					Duration: wi.Chapter.Duration(),
+					ExitCode: -1,
+				}
+				// don't start new jobs after cancellation; the remaining
+				// jobs are drained from the channel as cancelled.
+				if err := ctx.Err(); err != nil {
+					res.Err, res.Cancelled = err, true
+					notifyResult(obs, res)
+					chRes <- result{job.index, res}
+					continue
+				}
+				obs.OnStart(wi)
+				itemOpts := opts
+				itemOpts.Observer = itemObserver{wi: wi, progress: progress}
+				started := time.Now()
+				res.Stderr, res.ExitCode, res.Attempts, res.Err = wi.processWithRetries(ctx, itemOpts)
+				res.WallTime = time.Since(started)
+				res.Skipped = errors.Is(res.Err, ErrSkipped)
+				res.Cancelled = res.Err != nil && ctx.Err() != nil
+				progress.finish(wi, res.Skipped)
+				notifyResult(obs, res)
+				chRes <- result{job.index, res}
 			}
 		}()
 	}
 	// the channel was created with enough room to hold all jobs,
 	// so this should finish immediately
 	for i := range workItems {
-		chJob <- job{&workItems[i]}
+		chJob <- job{i, &workItems[i]}
 	}
 
-	var failed int
-	var successful int
+	results := make(Results, len(workItems))
 	for i := 0; i < len(workItems); i++ {
-		// TODO This receive may block indefinetely. Use select with timeouts?
-		// ALTHOUGH a large chapter may take a long time to process. How to
-		// distinguish long-running processes from those that have crashed?
+		// A crashed or hung ffmpeg is detected by the per-item timeouts
+		// and stall detection in ProcessOpts, if enabled.
 		res := <-chRes
-		if res.err != nil {
-			fmt.Println(fmt.Errorf("extraction failed: %v", res.err))
-			failed++
-		} else {
-			fmt.Println("Done:", res.wi.Outfile)
-			successful++
-		}
+		results[res.index] = res.res
 	}
 	close(chJob) // causes workers to exit loop
 	wg.Wait()    // wait workers
-	return Status{Successful: successful, Failed: failed, Submitted: len(workItems)}
+	obs.OnFinished(results)
+	return results
 }
 
 // Produce a printable string from Status
 func (s Status) String() string {
-	wtf := s.Submitted - (s.Successful + s.Failed)
-	return fmt.Sprintf("total %d submitted jobs => success: %d, failed: %d, missing: %d", s.Submitted, s.Successful, s.Failed, wtf)
+	wtf := s.Submitted - (s.Successful + s.Skipped + s.Failed + s.Cancelled)
+	return fmt.Sprintf("total %d submitted jobs => success: %d, skipped: %d, failed: %d, cancelled: %d, missing: %d",
+		s.Submitted, s.Successful, s.Skipped, s.Failed, s.Cancelled, wtf)
 }